@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"html/template"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// templateFuncs are available to every template
+var templateFuncs = template.FuncMap{
+	"t": func(tr Translations, key string) string {
+		return tr.Get(key)
+	},
+	// photoURL turns a stored participant photo into a data URL. Photos are
+	// re-encoded by the server, so the URL is safe to use in src attributes.
+	"photoURL": func(photo string) template.URL {
+		return template.URL("data:image/jpeg;base64," + photo)
+	},
+	"version": func() string {
+		return version
+	},
+	// nameWidth is the display length for names, e.g. {{truncate .Name nameWidth}}
+	"nameWidth": func() int {
+		return nameDisplayLength
+	},
+	"banner": func() *Banner {
+		if siteBanner.Text == "" {
+			return nil
+		}
+		return &siteBanner
+	},
+	"add":         add,
+	"formatTime":  formatTime,
+	"timeAgo":     timeAgo,
+	"truncate":    truncate,
+	"avatarColor": avatarColor,
+	"safeURL":     safeURL,
+}
+
+// add sums integers, e.g. {{add $i 1}} for 1-based numbering
+func add(values ...int) int {
+	sum := 0
+	for _, v := range values {
+		sum += v
+	}
+	return sum
+}
+
+// dateFormats holds the date layout of each supported language
+var dateFormats = map[string]string{
+	"en": "Jan 2, 2006 3:04 PM",
+	"fr": "02/01/2006 15:04",
+	"de": "02.01.2006 15:04",
+	"pt": "02/01/2006 15:04",
+	"it": "02/01/2006 15:04",
+}
+
+// formatTime renders a time.Time or an RFC 3339 string in the date format of
+// lang. Values that can't be parsed are returned unchanged.
+func formatTime(value interface{}, lang string) string {
+	var t time.Time
+	switch v := value.(type) {
+	case time.Time:
+		t = v
+	case *time.Time:
+		if v == nil {
+			return ""
+		}
+		t = *v
+	case string:
+		parsed, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return v
+		}
+		t = parsed
+	default:
+		return fmt.Sprint(value)
+	}
+	if t.IsZero() {
+		return ""
+	}
+	layout, ok := dateFormats[lang]
+	if !ok {
+		layout = dateFormats["en"]
+	}
+	return t.Format(layout)
+}
+
+// timeAgo describes how long ago t was in the language of tr, e.g. "2 hours ago"
+func timeAgo(t time.Time, tr Translations) string {
+	elapsed := timeNow().Sub(t)
+	var n int
+	var unit string
+	switch {
+	case elapsed < time.Minute:
+		return tr.Get("ago_just_now")
+	case elapsed < time.Hour:
+		n, unit = int(elapsed/time.Minute), "minute"
+	case elapsed < 24*time.Hour:
+		n, unit = int(elapsed/time.Hour), "hour"
+	default:
+		n, unit = int(elapsed/(24*time.Hour)), "day"
+	}
+	if n > 1 {
+		unit += "s"
+	}
+	return strings.ReplaceAll(tr.Get("ago_"+unit), "{n}", strconv.Itoa(n))
+}
+
+// truncate shortens s to at most n characters, ending with an ellipsis when cut.
+// It counts runes, so multibyte characters are never split.
+func truncate(s string, n int) string {
+	runes := []rune(s)
+	if n <= 0 {
+		return ""
+	}
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n-1]) + "…"
+}
+
+// avatarColor returns a stable CSS color derived from a name, so each
+// participant keeps the same color across pages
+func avatarColor(name string) string {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return fmt.Sprintf("hsl(%d, 55%%, 45%%)", h.Sum32()%360)
+}
+
+// safeURL returns the normalized form of an absolute http(s) URL, or an empty
+// string for anything else (javascript:, relative paths, garbage)
+func safeURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ""
+	}
+	u.User = nil
+	return u.String()
+}
@@ -1,27 +1,80 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/hmac"
 	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"embed"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/csv"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"html"
 	"html/template"
+	"image"
+	"image/color"
+	"image/jpeg"
+	_ "image/png" // registers the PNG decoder for photo uploads
 	"io"
 	"log"
+	"log/slog"
+	"maps"
+	"math/big"
 	mathrand "math/rand"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"secret-santa/ratelimit"
 )
 
 type Participant struct {
-	Name      string `json:"name"`
-	Wish      string `json:"wish"`
-	GiftFor   string `json:"giftFor"`
-	Submitted bool   `json:"submitted"`
+	Name         string            `json:"name"`
+	Wish         string            `json:"wish"`
+	GiftIdeas    []string          `json:"giftIdeas,omitempty"`
+	GiftFor      string            `json:"giftFor"`
+	Submitted    bool              `json:"submitted"`
+	Photo        string            `json:"photo,omitempty"` // base64 JPEG, photoSize pixels at most
+	JoinedAt     time.Time         `json:"joinedAt"`
+	ViewedAt     time.Time         `json:"viewedAt"`               // first visit to the result page after the draw
+	Language     string            `json:"language,omitempty"`     // detected when joining, one of supportedLanguages
+	IPHash       string            `json:"ipHash,omitempty"`       // HMAC of the IP they joined from, see hashIP
+	Avoid        []string          `json:"avoid,omitempty"`        // names they'd rather not draw, matched at draw time
+	CustomFields map[string]string `json:"customFields,omitempty"` // FieldDef.Key -> answer
+	GiftBought   string            `json:"giftBought,omitempty"`   // the giver's own purchase notes, never shown to anyone else
+	OptedOut     bool              `json:"optedOut,omitempty"`     // withdrew before the draw, kept but left out of it
+	OptedOutAt   *time.Time        `json:"optedOutAt,omitempty"`
+	Starred      bool              `json:"starred,omitempty"` // listed first for the organizer, no effect on the draw
+	Pending      bool              `json:"pending,omitempty"` // joined a draw with ApprovalRequired and awaits the organizer
+}
+
+// FieldDef is an extra question the organizer adds to the join form
+type FieldDef struct {
+	Key       string `json:"key"`
+	Label     string `json:"label"`
+	Required  bool   `json:"required,omitempty"`
+	MaxLength int    `json:"maxLength"`
 }
 
 type Draw struct {
@@ -30,616 +83,4375 @@ type Draw struct {
 	Participants         map[string]*Participant `json:"participants"`
 	DrawDone             bool                    `json:"drawDone"`
 	CreatedAt            time.Time               `json:"createdAt"`
+	DrawnAt              *time.Time              `json:"drawnAt,omitempty"` // nil until the draw is done
+	NameSimilarityCheck  bool                    `json:"nameSimilarityCheck,omitempty"`
+	SurpriseReveal       bool                    `json:"surpriseReveal,omitempty"`      // reveal the recipient on a second page
+	RequireWishes        bool                    `json:"requireWishes,omitempty"`       // refuse to draw while someone has no wish
+	NoNameNeighbors      bool                    `json:"noNameNeighbors,omitempty"`     // nobody draws the name just before or after theirs alphabetically
+	PublicNames          bool                    `json:"publicNames,omitempty"`         // include names in the public /status participant list
+	FlagDuplicateWishes  bool                    `json:"flagDuplicateWishes,omitempty"` // point out identical wishes to the organizer, see duplicateWishes
+	ApprovalRequired     bool                    `json:"approvalRequired,omitempty"`    // joins wait for the organizer to approve them
+	CreatedByIP          string                  `json:"createdByIP,omitempty"`         // HMAC of the creator's IP, see hashIP
+	ShuffleHistory       []ShuffleRecord         `json:"shuffleHistory,omitempty"`
+	ManuallyAdjusted     bool                    `json:"manuallyAdjusted,omitempty"`
+	AuditLog             []AuditEntry            `json:"auditLog,omitempty"`
+	OrganizerToken       string                  `json:"organizerToken,omitempty"`  // the organizer's participant token
+	MaxWishLength        *int                    `json:"maxWishLength,omitempty"`   // nil uses maxWishLength
+	BannedIPs            []string                `json:"bannedIPs,omitempty"`       // HMACs of IPs that may not join, see hashIP
+	Pins                 map[string]string       `json:"pins,omitempty"`            // giver token -> receiver token fixed by the organizer
+	OriginalNames        map[string]string       `json:"originalNames,omitempty"`   // token -> real name while shuffle-names hides them behind codenames
+	CodenamesIssued      int                     `json:"codenamesIssued,omitempty"` // codenames handed out so far, the next one is codename(CodenamesIssued)
+	MergedInto           string                  `json:"mergedInto,omitempty"`      // ID of the draw this one's participants were moved to, its URLs redirect there
+	ShortID              string                  `json:"shortId,omitempty"`         // for sharing as /s/{shortId}, the map key stays canonical
+	JoinCode             string                  `json:"joinCode,omitempty"`        // e.g. PINE-OAK-STAR-WREN-4821, easy to say out loud, resolved by /join?code=
+	Tags                 []string                `json:"tags,omitempty"`            // organizer-defined, see normalizeTags
+	JoinExpiresAt        *time.Time              `json:"joinExpiresAt,omitempty"`   // nil when the join link never expires
+	Locale               string                  `json:"locale,omitempty"`          // language of all the draw's pages, see drawLanguage
+
+	// CustomFieldDefinitions are the organizer's extra questions on the join form
+	CustomFieldDefinitions []FieldDef `json:"customFieldDefinitions,omitempty"`
+
+	// participantCount mirrors len(activeParticipants()) so the join capacity
+	// check doesn't need dataMutex. It is updated together with the map.
+	participantCount atomic.Int32
+
+	// demo marks a /draw/demo sandbox, see demoDraws
+	demo bool
+}
+
+// isOrganizer reports whether token is the organizer's participant token.
+// Draws created before OrganizerToken was recorded have no organizer.
+func (d *Draw) isOrganizer(token string) bool {
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(d.OrganizerToken)) == 1
+}
+
+// joinExpired reports whether the join link no longer accepts participants
+// Note: This function should be called when dataMutex is already locked
+func (d *Draw) joinExpired() bool {
+	return d.JoinExpiresAt != nil && timeNow().After(*d.JoinExpiresAt)
+}
+
+// wishLimit returns the maximum wish length for this draw
+func (d *Draw) wishLimit() int {
+	if d.MaxWishLength != nil {
+		return *d.MaxWishLength
+	}
+	return maxWishLength
+}
+
+// constraints returns the form limits for this draw's join page
+func (d *Draw) constraints() Constraints {
+	c := formConstraints
+	c.MaxWishLength = d.wishLimit()
+	return c
+}
+
+// activeParticipants returns the participants who haven't opted out and
+// aren't awaiting approval, the pool the draw is made from
+// Note: This function should be called when dataMutex is already locked
+func (d *Draw) activeParticipants() map[string]*Participant {
+	active := make(map[string]*Participant, len(d.Participants))
+	for t, p := range d.Participants {
+		if !p.OptedOut && !p.Pending {
+			active[t] = p
+		}
+	}
+	return active
+}
+
+// realName returns the name a participant joined with, even while
+// shuffle-names shows a codename instead
+// Note: This function should be called when dataMutex is already locked
+func (d *Draw) realName(token string) string {
+	if name, ok := d.OriginalNames[token]; ok {
+		return name
+	}
+	return d.Participants[token].Name
+}
+
+// shuffleSnapshot copies what assignGifts reads from the draw, so the shuffle
+// can run without holding dataMutex
+// Note: This function should be called when dataMutex is already locked
+func (d *Draw) shuffleSnapshot() *Draw {
+	snapshot := &Draw{
+		Participants:    make(map[string]*Participant),
+		NoNameNeighbors: d.NoNameNeighbors,
+		Pins:            maps.Clone(d.Pins),
+		OriginalNames:   maps.Clone(d.OriginalNames),
+	}
+	for t, p := range d.activeParticipants() {
+		snapshot.Participants[t] = &Participant{Name: p.Name, Avoid: slices.Clone(p.Avoid)}
+	}
+	return snapshot
+}
+
+// participantTotal returns the number of participants without taking dataMutex
+func (d *Draw) participantTotal() int {
+	return int(d.participantCount.Load())
+}
+
+// AuditEntry records a sensitive action taken on a draw
+type AuditEntry struct {
+	At     time.Time `json:"at"`
+	Action string    `json:"action"`
+	Detail string    `json:"detail"`
+}
+
+// ShuffleRecord keeps track of one draw attempt so its randomness can be audited
+type ShuffleRecord struct {
+	AttemptedAt    time.Time `json:"attemptedAt"`
+	SeedHex        string    `json:"seedHex"`
+	Succeeded      bool      `json:"succeeded"`
+	AssignmentHash string    `json:"assignmentHash"`
 }
 
 type Data struct {
-	Events map[string]*Draw `json:"events"`
+	Events   map[string]*Draw `json:"events"`
+	Checksum string           `json:"checksum,omitempty"` // SHA-256 of the "events" bytes as written, see fileChecksum
+}
+
+// Translations holds the strings of one language along with the English
+// strings used for keys that language doesn't define
+type Translations struct {
+	primary  map[string]string
+	fallback map[string]string
+}
+
+// lookup returns the translation for key, falling back to English
+func (t Translations) lookup(key string) (string, bool) {
+	if v := t.primary[key]; v != "" {
+		return v, true
+	}
+	if v := t.fallback[key]; v != "" {
+		return v, true
+	}
+	return "", false
+}
+
+// Get returns the translation for key, the English text when it's missing,
+// or the key itself as a last resort so gaps are visible instead of blank
+func (t Translations) Get(key string) string {
+	if v, ok := t.lookup(key); ok {
+		return v
+	}
+	return key
+}
+
+// Banner is an operator notice shown at the top of every page
+type Banner struct {
+	Text     string // literal text or a translation key
+	Severity string // info, warning or critical
+}
+
+// readOnlyMode is set from READ_ONLY: "true" stops new draws from being created,
+// "all" also freezes joining and drawing in existing draws
+var readOnlyMode = strings.ToLower(os.Getenv("READ_ONLY"))
+
+func creationDisabled() bool {
+	return readOnlyMode == "true" || readOnlyMode == "all"
+}
+
+func drawsFrozen() bool {
+	return readOnlyMode == "all"
 }
 
-type Translations map[string]string
+// siteBanner is configured through BANNER and BANNER_SEVERITY, empty means no banner
+var siteBanner = loadBanner()
 
-var templates = template.Must(template.ParseGlob("templates/*.html"))
+// templateFS holds the templates inside the binary. Only the templates: locales/
+// and static/ are still read from the working directory at runtime.
+// ParseFS names each template after its file's base name, e.g. "manage.html".
+//
+//go:embed templates/*.html
+var templateFS embed.FS
+
+var templates = template.Must(template.New("").Funcs(templateFuncs).ParseFS(templateFS, "templates/*.html"))
 var dataFile = "data.json"
 var appData Data
 var dataMutex sync.RWMutex
 
+// version is set at build time with -ldflags "-X main.version=1.2.3"
+var version = "dev"
+
+// startTime is reported as uptime by the detailed health check
+var startTime = time.Now()
+
+// supportedLanguages lists the locales shipped in locales/
+var supportedLanguages = []string{"en", "fr", "de", "pt", "it"}
+
+// timeNow is the clock used for draw timestamps and deadlines, replaceable in tests
+var timeNow = time.Now
+
+// minWaitBeforeDraw is how long after creation a draw can be started, from
+// MIN_WAIT_BEFORE_DRAW (e.g. "1h"). Zero allows drawing right away.
+var minWaitBeforeDraw = envDuration("MIN_WAIT_BEFORE_DRAW", 0)
+
+// joinURLTTL (JOIN_URL_TTL) makes join links expire that long after the draw is
+// created. Organizers can extend them by the same duration. 0 disables expiry.
+var joinURLTTL = envDuration("JOIN_URL_TTL", 0)
+
+// drawSubscribers holds the live-update channels of clients watching each draw.
+// It is guarded by dataMutex so updates are sent under the same lock as the change.
+var drawSubscribers = make(map[string]map[chan drawUpdate]struct{})
+
+// streamsPerIP counts the open live-update streams of each client IP. Streams
+// stay open for as long as the page does and skip limitConcurrency, so they
+// have their own caps. Guarded by dataMutex.
+var streamsPerIP = make(map[string]int)
+
+const (
+	maxStreamsPerDraw = 20
+	maxStreamsPerIP   = 4
+)
+
 const (
 	maxNameLength   = 100
 	maxWishLength   = 500
+	maxWishCeiling  = 2000 // upper bound for a draw's own wish length limit
 	maxActiveEvents = 1000
+	maxGiftIdeas    = 5
+	maxGiftIdeaLen  = 200
+	maxAvoidNames   = 10
+	maxCustomFields = 5
+	maxFieldLength  = 200
+	maxGiftBought   = 300
+	maxTags         = 5
+	maxTagLength    = 30
+	minParticipants = 3
+	maxParticipants = 50
+	// maxParticipantRows caps the rows a draw keeps, opted-out ones included,
+	// so joining and opting out again can't grow it forever
+	maxParticipantRows = 2 * maxParticipants
+	maxPhotoBytes      = 512 << 10
+	maxPhotoPixels     = 2000 // per side, a small file can declare a huge image
+	photoSize          = 100
 )
 
-// generateSecureToken generates a cryptographically secure random token
-func generateSecureToken() string {
-	bytes := make([]byte, 16) // 16 bytes = 32 hex characters
-	if _, err := cryptorand.Read(bytes); err != nil {
-		log.Fatal(err)
-	}
-	return hex.EncodeToString(bytes)
+// Constraints exposes the server-side validation limits to the form templates
+// so client-side validation stays in sync with validateInput
+type Constraints struct {
+	MaxNameLength   int
+	MaxWishLength   int
+	MaxWishCeiling  int
+	MaxGiftIdeas    int
+	MaxGiftBought   int
+	MinParticipants int
+	MaxParticipants int
 }
 
-// validateInput sanitizes and validates user input
-func validateInput(input string, maxLength int, fieldName string) (string, error) {
-	// Trim whitespace
-	input = strings.TrimSpace(input)
+var formConstraints = Constraints{
+	MaxNameLength:   maxNameLength,
+	MaxWishLength:   maxWishLength,
+	MaxWishCeiling:  maxWishCeiling,
+	MaxGiftIdeas:    maxGiftIdeas,
+	MaxGiftBought:   maxGiftBought,
+	MinParticipants: minParticipants,
+	MaxParticipants: maxParticipants,
+}
 
-	// Check if empty
-	if input == "" {
-		return "", fmt.Errorf("%s cannot be empty", fieldName)
-	}
+// nameSimilarityDistance is the largest edit distance at which two names are
+// reported as possibly the same person (e.g. "Jon" and "John")
+var nameSimilarityDistance = envInt("NAME_SIMILARITY_DISTANCE", 2)
 
-	// Check length
-	if len(input) > maxLength {
-		return "", fmt.Errorf("%s is too long (max %d characters)", fieldName, maxLength)
+// nameDisplayLength (NAME_DISPLAY_LENGTH) is how many characters of a draw or
+// participant name pages show before cutting it with an ellipsis, the full
+// name stays in the tooltip
+var nameDisplayLength = envInt("NAME_DISPLAY_LENGTH", 40)
+
+func loadBanner() Banner {
+	severity := os.Getenv("BANNER_SEVERITY")
+	if severity != "warning" && severity != "critical" {
+		severity = "info"
+	}
+	text := strings.TrimSpace(os.Getenv("BANNER"))
+	if text == "" && creationDisabled() {
+		// Explain the read-only mode unless the operator wrote their own notice
+		if drawsFrozen() {
+			return Banner{Text: "read_only_all_banner", Severity: "warning"}
+		}
+		return Banner{Text: "read_only_banner", Severity: "warning"}
 	}
+	return Banner{Text: text, Severity: severity}
+}
 
-	return input, nil
+// bufferPool recycles the buffers templates are rendered into
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
 }
 
-func main() {
-	mathrand.Seed(time.Now().UnixNano())
-	loadData()
+// renderTemplate executes a template into a buffer first and only writes it to w
+// once it succeeded, so a failing template never sends a partial page
+func renderTemplate(w http.ResponseWriter, name string, data interface{}) error {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer bufferPool.Put(buf)
 
-	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
+	if err := templates.ExecuteTemplate(buf, name, data); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_, err := buf.WriteTo(w)
+	return err
+}
 
-	// Serve robots.txt and sitemap.xml at the site root to aid crawlers
-	http.HandleFunc("/robots.txt", func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, "static/robots.txt")
-	})
-	http.HandleFunc("/sitemap.xml", func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, "static/sitemap.xml")
-	})
+// ipHashKey keys the HMAC used to store IP addresses without keeping them in clear.
+// Without IP_HASH_KEY a random key is used and hashes don't survive a restart.
+var ipHashKey = loadIPHashKey()
 
-	http.HandleFunc("/", homeHandler)
-	http.HandleFunc("/draw/create", createDrawHandler)
-	http.HandleFunc("/draw/", drawHandler)
+// ownDrawsMaxAge limits /draw/mine to recent draws to limit privacy exposure
+const ownDrawsMaxAge = 7 * 24 * time.Hour
 
-	// Get port from environment variable or default to 8080
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+func loadIPHashKey() []byte {
+	if key := os.Getenv("IP_HASH_KEY"); key != "" {
+		return []byte(key)
+	}
+	key := make([]byte, 32)
+	if _, err := cryptorand.Read(key); err != nil {
+		log.Fatal(err)
 	}
+	return key
+}
 
-	fmt.Printf("Server started at http://localhost:%s\n", port)
+// hashIP returns a keyed hash of an IP address so raw addresses are never stored
+func hashIP(ip string) string {
+	mac := hmac.New(sha256.New, ipHashKey)
+	mac.Write([]byte(ip))
+	return hex.EncodeToString(mac.Sum(nil))
+}
 
-	mux := http.DefaultServeMux
+// trustedProxies are the reverse proxies allowed to tell the visitor's address
+// through Fly-Client-IP or X-Forwarded-For, from TRUSTED_PROXIES
+var trustedProxies = parseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
 
-	// forceHTTPS redirects HTTP -> HTTPS for non-local requests using a 301.
-	// We intentionally allow localhost and private/local IP ranges to remain on HTTP for local dev.
-	forceHTTPS := func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if !isHTTPS(r) && !isLocalHost(r.Host) {
-				// Redirect to the canonical page directly to avoid an intermediate root redirect.
-				destination := "https://" + r.Host + r.URL.RequestURI()
-				if r.URL.Path == "/" {
-					destination = "https://" + r.Host + "/draw/create"
-				}
-				http.Redirect(w, r, destination, http.StatusMovedPermanently)
-				return
-			}
-			// Add HSTS header for secure responses to enforce HTTPS
-			if isHTTPS(r) && !isLocalHost(r.Host) {
-				w.Header().Set("Strict-Transport-Security", "max-age=63072000; includeSubDomains; preload")
+// parseTrustedProxies reads a comma-separated list of IP addresses and CIDR
+// ranges. Invalid entries are logged and skipped.
+func parseTrustedProxies(value string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
 			}
-			next.ServeHTTP(w, r)
-		})
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			log.Printf("TRUSTED_PROXIES: ignoring %q: %v", entry, err)
+			continue
+		}
+		nets = append(nets, ipNet)
 	}
-
-	handler := forceHTTPS(mux)
-
-	log.Fatal(http.ListenAndServe(":"+port, handler))
+	return nets
 }
 
-// isLocalHost returns true for localhost, loopback and common private IP ranges.
-func isLocalHost(hostport string) bool {
-	host := hostport
-	if h, _, err := net.SplitHostPort(hostport); err == nil {
-		host = h
-	}
-	host = strings.ToLower(host)
-	if host == "localhost" {
-		return true
-	}
-	ip := net.ParseIP(host)
-	if ip == nil {
+// isTrustedProxy reports whether ip belongs to one of trustedProxies
+func isTrustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
 		return false
 	}
-	if ip.IsLoopback() {
-		return true
-	}
-	// Check common private and local ranges using CIDRs
-	cidrs := []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7", "fe80::/10"}
-	for _, c := range cidrs {
-		_, netw, _ := net.ParseCIDR(c)
-		if netw != nil && netw.Contains(ip) {
+	for _, ipNet := range trustedProxies {
+		if ipNet.Contains(parsed) {
 			return true
 		}
 	}
 	return false
 }
 
-func isHTTPS(r *http.Request) bool {
-	if r.TLS != nil {
-		return true
+// clientIP returns the address of the visitor. Proxy headers are only believed
+// when the direct peer is a trusted proxy, anyone else could make them up. Then
+// Fly-Client-IP wins, otherwise the right-most X-Forwarded-For hop that isn't
+// one of our proxies, since the entries left of it are supplied by the client.
+func clientIP(r *http.Request) string {
+	peer := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		peer = host
 	}
-	proto := r.Header.Get("X-Forwarded-Proto")
-	if strings.EqualFold(proto, "https") {
-		return true
+	if !isTrustedProxy(peer) {
+		return peer
 	}
-	return false
+	if ip := strings.TrimSpace(r.Header.Get("Fly-Client-IP")); ip != "" {
+		return ip
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop != "" && !isTrustedProxy(hop) {
+			return hop
+		}
+	}
+	return peer
 }
 
-func loadData() {
-	dataMutex.Lock()
-	defer dataMutex.Unlock()
-
-	file, err := os.Open(dataFile)
-	if err != nil {
-		fmt.Println("Data file not found, creating new one.")
-		appData.Events = make(map[string]*Draw)
-		return
+// baseURL returns the scheme and host the visitor used to reach the site
+func baseURL(r *http.Request) string {
+	if isLocalHost(r.Host) {
+		return "http://" + r.Host
 	}
-	defer file.Close()
+	return "https://" + r.Host
+}
 
-	bytes, err := io.ReadAll(file)
-	if err != nil {
-		log.Printf("Error reading data file: %v", err)
-		appData.Events = make(map[string]*Draw)
+// render writes a page with renderTemplate. If the template fails (a typo in the
+// name, a missing file or an execution error) it logs the error and serves a
+// generic localized error page with a 500 instead of a blank 200.
+func render(w http.ResponseWriter, r *http.Request, name string, data interface{}) {
+	err := renderTemplate(w, name, data)
+	if err == nil {
 		return
 	}
+	log.Printf("Error rendering template %s: %v", name, err)
 
-	if err := json.Unmarshal(bytes, &appData); err != nil {
-		log.Printf("Error parsing data file: %v", err)
-		appData.Events = make(map[string]*Draw)
-		return
-	}
+	t := loadTranslations(getLanguage(r))
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusInternalServerError)
+	fmt.Fprintf(w, `<!DOCTYPE html>
+<html>
+<head><meta charset="UTF-8"><title>%[1]s</title><link rel="stylesheet" href="/static/style.css"></head>
+<body><div class="container"><div class="card"><h1>%[1]s</h1><p>%[2]s</p></div></div></body>
+</html>`, html.EscapeString(t.Get("error_page_title")), html.EscapeString(t.Get("error_page_message")))
+}
 
-	cleanupOldEvents()
+// generateShortID returns a 6-character base36 ID for short join links
+func generateShortID() string {
+	const alphabet = "0123456789abcdefghijklmnopqrstuvwxyz"
+	bytes := make([]byte, 6)
+	for i := range bytes {
+		n, err := cryptorand.Int(cryptorand.Reader, big.NewInt(int64(len(alphabet))))
+		if err != nil {
+			log.Fatal(err)
+		}
+		bytes[i] = alphabet[n.Int64()]
+	}
+	return string(bytes)
 }
 
-// cleanupOldEvents removes draws older than 30 days
+// uniqueShortID returns a short ID no other draw uses.
 // Note: This function should be called when dataMutex is already locked
-func cleanupOldEvents() {
-	cutoffDate := time.Now().AddDate(0, 0, -30)
-	deleted := 0
-	for id, draw := range appData.Events {
-		if draw.CreatedAt.Before(cutoffDate) {
-			delete(appData.Events, id)
-			deleted++
+func uniqueShortID() string {
+	for {
+		shortID := generateShortID()
+		if _, ok := findShortID(shortID); !ok {
+			return shortID
 		}
 	}
-	if deleted > 0 {
-		fmt.Printf("Cleaned up %d old draws (older than 30 days)\n", deleted)
-		saveDataUnsafe()
-	}
 }
 
-func saveData() {
-	dataMutex.Lock()
-	defer dataMutex.Unlock()
-	saveDataUnsafe()
+// findShortID returns the full ID of the draw with this short ID.
+// Note: This function should be called when dataMutex is already locked
+func findShortID(shortID string) (string, bool) {
+	for id, draw := range appData.Events {
+		if draw.ShortID == shortID {
+			return id, true
+		}
+	}
+	return "", false
 }
 
-// saveDataUnsafe saves data without acquiring the mutex (for when already locked)
-func saveDataUnsafe() {
-	bytes, err := json.MarshalIndent(appData, "", "  ")
-	if err != nil {
-		log.Printf("Error marshaling data: %v", err)
-		return
+// shortLinkHandler redirects /s/{shortId} to the draw's join page
+func shortLinkHandler(w http.ResponseWriter, r *http.Request) {
+	shortID := strings.ToLower(strings.TrimPrefix(r.URL.Path, "/s/"))
+	dataMutex.RLock()
+	id, ok := "", false
+	if shortID != "" {
+		id, ok = findShortID(shortID)
 	}
-
-	if err := os.WriteFile(dataFile, bytes, 0644); err != nil {
-		log.Printf("Error writing data file: %v", err)
+	dataMutex.RUnlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
 	}
+	http.Redirect(w, r, "/draw/"+id+"/join", http.StatusFound)
 }
 
-func getLanguage(r *http.Request) string {
-	// Check query parameter first (for manual override)
-	lang := r.URL.Query().Get("lang")
-	if lang != "" {
-		return lang
-	}
+// joinCodeWords are short, unambiguous words for join codes. A code resolves
+// to the draw ID, which opens its manage page, so codes must not be guessable:
+// four words and a four-digit number give 64^4 * 9000, about 1.5e11 codes, and
+// joinCodeLimiter bounds how fast they can be tried.
+var joinCodeWords = []string{
+	"ALDER", "APPLE", "ASH", "BEAR", "BELL", "BIRCH", "BOOT", "BROOK",
+	"CANDY", "CEDAR", "CHALK", "CLOUD", "COCOA", "COMET", "CRANE", "DEER",
+	"DOVE", "ELF", "ELM", "FERN", "FIG", "FIR", "FOX", "FROST",
+	"GIFT", "GLOVE", "HARE", "HAZEL", "HOLLY", "ICE", "IVY", "JOLLY",
+	"LARK", "LEMON", "MAPLE", "MINT", "MOON", "MOSS", "NUT", "OAK",
+	"OWL", "PEAR", "PINE", "PLUM", "POLAR", "QUILL", "RAVEN", "RIBBON",
+	"ROBIN", "SLED", "SNOW", "SPRUCE", "STAR", "SWAN", "TINSEL", "TOY",
+	"WALNUT", "WILLOW", "WINTER", "WOLF", "WREN", "YEW", "YULE", "ZEST",
+}
 
-	// Parse Accept-Language header
-	acceptLang := r.Header.Get("Accept-Language")
-	if acceptLang != "" {
-		// Accept-Language format: "en-US,en;q=0.9,fr;q=0.8"
-		langs := parseAcceptLanguage(acceptLang)
-		for _, l := range langs {
-			// Check if we support this language
-			if l == "en" || l == "fr" || l == "de" || l == "pt" || l == "it" {
-				return l
-			}
+// generateJoinCode returns a code of four words and a number such as
+// PINE-OAK-STAR-WREN-4821
+func generateJoinCode() string {
+	pick := func(n int64) int64 {
+		v, err := cryptorand.Int(cryptorand.Reader, big.NewInt(n))
+		if err != nil {
+			log.Fatal(err)
 		}
+		return v.Int64()
 	}
-
-	// Default to English
-	return "en"
+	parts := make([]string, 0, 5)
+	for i := 0; i < 4; i++ {
+		parts = append(parts, joinCodeWords[pick(int64(len(joinCodeWords)))])
+	}
+	parts = append(parts, strconv.FormatInt(1000+pick(9000), 10))
+	return strings.Join(parts, "-")
 }
 
-func parseAcceptLanguage(header string) []string {
-	var langs []string
-	for _, part := range splitByComma(header) {
-		// Split by semicolon to remove quality values (;q=0.9)
-		langPart := part
-		if idx := indexByte(part, ';'); idx != -1 {
-			langPart = part[:idx]
-		}
-		// Trim spaces and extract base language (en-US -> en)
-		langPart = trimSpace(langPart)
-		if idx := indexByte(langPart, '-'); idx != -1 {
-			langPart = langPart[:idx]
-		}
-		if langPart != "" {
-			langs = append(langs, langPart)
+// uniqueJoinCode returns a join code no other draw uses.
+// Note: This function should be called when dataMutex is already locked
+func uniqueJoinCode() string {
+	for {
+		code := generateJoinCode()
+		if _, ok := findJoinCode(code); !ok {
+			return code
 		}
 	}
-	return langs
 }
 
-func splitByComma(s string) []string {
-	var result []string
-	start := 0
-	for i := 0; i < len(s); i++ {
-		if s[i] == ',' {
-			result = append(result, s[start:i])
-			start = i + 1
+// findJoinCode returns the full ID of the draw with this join code, ignoring case
+// and surrounding spaces.
+// Note: This function should be called when dataMutex is already locked
+func findJoinCode(code string) (string, bool) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	for id, draw := range appData.Events {
+		if draw.JoinCode == code {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+// joinCodeLimiter caps how many join codes one IP address can look up per
+// minute (JOIN_CODE_RATE_LIMIT, 0 disables it), so codes can't be brute-forced
+var joinCodeLimiter = ratelimit.New(envLimit("JOIN_CODE_RATE_LIMIT", 20), time.Minute)
+
+// joinCodeHandler redirects /join?code=PINE-OAK-STAR-WREN-4821 to the draw's join page
+func joinCodeHandler(w http.ResponseWriter, r *http.Request) {
+	if !joinCodeLimiter.Allow(clientIP(r)) {
+		w.Header().Set("Retry-After", "60")
+		writeError(w, r, http.StatusTooManyRequests, "rate_limited")
+		return
+	}
+	code := r.URL.Query().Get("code")
+	dataMutex.RLock()
+	id, ok := "", false
+	if code != "" {
+		id, ok = findJoinCode(code)
+	}
+	dataMutex.RUnlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	http.Redirect(w, r, "/draw/"+id+"/join", http.StatusFound)
+}
+
+// generateSecureToken generates a cryptographically secure random token
+func generateSecureToken() string {
+	bytes := make([]byte, 16) // 16 bytes = 32 hex characters
+	if _, err := cryptorand.Read(bytes); err != nil {
+		log.Fatal(err)
+	}
+	return hex.EncodeToString(bytes)
+}
+
+// publicID derives a stable, opaque ID from a participant token. The token
+// can't be recovered from it, so it is safe to show to anyone.
+func publicID(token string) string {
+	sum := sha256.Sum256([]byte("participant:" + token))
+	return hex.EncodeToString(sum[:8])
+}
+
+// generateSeed returns a random shuffle seed from crypto/rand along with its hex form
+func generateSeed() (int64, string) {
+	bytes := make([]byte, 8)
+	if _, err := cryptorand.Read(bytes); err != nil {
+		log.Fatal(err)
+	}
+	return int64(binary.BigEndian.Uint64(bytes)), hex.EncodeToString(bytes)
+}
+
+// parseSeed converts a hex seed as stored in ShuffleHistory back to a seed value
+func parseSeed(seedHex string) (int64, error) {
+	bytes, err := hex.DecodeString(seedHex)
+	if err != nil || len(bytes) != 8 {
+		return 0, fmt.Errorf("invalid seed %q", seedHex)
+	}
+	return int64(binary.BigEndian.Uint64(bytes)), nil
+}
+
+// errInfeasiblePins is returned when the pinned pairs can't all be part of a
+// single gift cycle, e.g. two givers pinned to the same receiver
+var errInfeasiblePins = errors.New("the pinned pairs leave no valid assignment")
+
+// errInfeasibleExclusions is returned when no shuffle respects the exclusions
+var errInfeasibleExclusions = errors.New("no assignment respects everyone's exclusions, ask someone to remove one")
+
+// errAssignmentNotFound is returned when the search for an assignment gave up
+// before proving there is none, drawing again may succeed
+var errAssignmentNotFound = errors.New("no assignment respecting everyone's exclusions was found in time, please try again")
+
+// minNeighborFreeParticipants is the smallest group that can be drawn with
+// NoNameNeighbors, with 4 or fewer no single gift cycle avoids every neighbor
+const minNeighborFreeParticipants = 5
+
+// maxShuffleAttempts bounds the reshuffles made to satisfy exclusions
+const maxShuffleAttempts = 1000
+
+// maxSearchSteps bounds the search findCycle runs once reshuffling failed
+const maxSearchSteps = 1000000
+
+// exclusions resolves the names participants would rather not draw to giver
+// token -> excluded receiver tokens. Names are matched case-insensitively and
+// unknown names are ignored.
+// Note: This function should be called when dataMutex is already locked
+func (d *Draw) exclusions() map[string]map[string]bool {
+	excluded := make(map[string]map[string]bool)
+	exclude := func(giver, receiver string) {
+		if excluded[giver] == nil {
+			excluded[giver] = make(map[string]bool)
+		}
+		excluded[giver][receiver] = true
+	}
+	active := d.activeParticipants()
+	for giver, p := range active {
+		for _, name := range p.Avoid {
+			for receiver := range active {
+				if strings.EqualFold(d.realName(receiver), name) {
+					exclude(giver, receiver)
+				}
+			}
+		}
+	}
+
+	if d.NoNameNeighbors {
+		tokens := make([]string, 0, len(active))
+		for t := range active {
+			tokens = append(tokens, t)
+		}
+		sort.Slice(tokens, func(i, j int) bool {
+			return strings.ToLower(d.realName(tokens[i])) < strings.ToLower(d.realName(tokens[j]))
+		})
+		for i := 1; i < len(tokens); i++ {
+			exclude(tokens[i-1], tokens[i])
+			exclude(tokens[i], tokens[i-1])
+		}
+	}
+	return excluded
+}
+
+// checkPins validates pinned giver -> receiver tokens against the participants
+func checkPins(participants map[string]*Participant, pins map[string]string) error {
+	receivers := make(map[string]bool, len(pins))
+	for giver, receiver := range pins {
+		if participants[giver] == nil || participants[receiver] == nil || giver == receiver || receivers[receiver] {
+			return errInfeasiblePins
+		}
+		receivers[receiver] = true
+	}
+	return nil
+}
+
+// assignGifts shuffles the draw's participants using the given seed and links
+// them in a single cycle so nobody draws themselves. Pinned giver -> receiver
+// tokens are kept as fixed links and exclusions are honored by reshuffling,
+// then by searching with findCycle when the reshuffles all failed.
+// It returns giver token -> receiver name.
+// Note: This function should be called when dataMutex is already locked, or
+// on a shuffleSnapshot which needs no lock
+func assignGifts(d *Draw, seed int64) (map[string]string, error) {
+	participants, pins := d.activeParticipants(), d.Pins
+	if err := checkPins(participants, pins); err != nil {
+		return nil, err
+	}
+	if d.NoNameNeighbors && len(participants) < minNeighborFreeParticipants {
+		return nil, errInfeasibleExclusions
+	}
+	excluded := d.exclusions()
+	for giver, receiver := range pins {
+		if excluded[giver][receiver] {
+			return nil, errInfeasibleExclusions
+		}
+	}
+	pinned := make(map[string]bool, len(pins))
+	for _, receiver := range pins {
+		pinned[receiver] = true
+	}
+
+	// Shuffle chains instead of people: each chain starts with someone nobody is
+	// pinned to and follows the pins. Without pins every chain is one person.
+	starts := make([]string, 0, len(participants))
+	for t := range participants {
+		if !pinned[t] {
+			starts = append(starts, t)
+		}
+	}
+	// Map iteration order is random, sort first so a seed always replays the same way
+	sort.Strings(starts)
+	rng := mathrand.New(mathrand.NewSource(seed))
+
+	// Reshuffling with the same rng keeps the result reproducible from the seed
+	for attempt := 0; attempt < maxShuffleAttempts; attempt++ {
+		rng.Shuffle(len(starts), func(i, j int) { starts[i], starts[j] = starts[j], starts[i] })
+
+		tokens := make([]string, 0, len(participants))
+		for _, t := range starts {
+			for ; t != ""; t = pins[t] {
+				tokens = append(tokens, t)
+			}
+		}
+		// Pins closing a loop are never reached from a chain start
+		if len(tokens) != len(participants) {
+			return nil, errInfeasiblePins
+		}
+
+		if assignment, ok := linkCycle(tokens, participants, excluded); ok {
+			return assignment, nil
+		}
+	}
+
+	// Heavy exclusions leave few valid cycles, look for one systematically
+	chains := make([][]string, len(starts))
+	for i, t := range starts {
+		for ; t != ""; t = pins[t] {
+			chains[i] = append(chains[i], t)
+		}
+	}
+	tokens, err := findCycle(chains, excluded)
+	if err != nil {
+		return nil, err
+	}
+	assignment, _ := linkCycle(tokens, participants, excluded)
+	return assignment, nil
+}
+
+// linkCycle has each token give to the next one, the last to the first. It
+// returns giver token -> receiver name, or false if a link is excluded.
+func linkCycle(tokens []string, participants map[string]*Participant, excluded map[string]map[string]bool) (map[string]string, bool) {
+	assignment := make(map[string]string, len(tokens))
+	for i, t := range tokens {
+		next := tokens[(i+1)%len(tokens)]
+		if excluded[t][next] {
+			return nil, false
+		}
+		assignment[t] = participants[next].Name
+	}
+	return assignment, true
+}
+
+// findCycle orders the chains of pinned tokens into a single cycle where the
+// last of each chain may give to the first of the next, trying chains in the
+// given order. It returns the tokens in giving order, errInfeasibleExclusions
+// when no such order exists and errAssignmentNotFound when it gave up first.
+func findCycle(chains [][]string, excluded map[string]map[string]bool) ([]string, error) {
+	n := len(chains)
+	allowed := func(from, to int) bool {
+		return !excluded[chains[from][len(chains[from])-1]][chains[to][0]]
+	}
+	// Someone nobody may give to, or who may give to nobody, rules out any cycle
+	for i := 0; i < n && n > 1; i++ {
+		gives, receives := false, false
+		for j := 0; j < n; j++ {
+			if i != j {
+				gives = gives || allowed(i, j)
+				receives = receives || allowed(j, i)
+			}
+		}
+		if !gives || !receives {
+			return nil, errInfeasibleExclusions
+		}
+	}
+
+	// Every cycle goes through the first chain, start from it
+	order := []int{0}
+	used := make([]bool, n)
+	used[0] = true
+	steps := 0
+	var extend func(last int) (bool, error)
+	extend = func(last int) (bool, error) {
+		if len(order) == n {
+			return allowed(last, 0), nil
+		}
+		for next := 1; next < n; next++ {
+			if used[next] || !allowed(last, next) {
+				continue
+			}
+			if steps++; steps > maxSearchSteps {
+				return false, errAssignmentNotFound
+			}
+			used[next] = true
+			order = append(order, next)
+			if found, err := extend(next); found || err != nil {
+				return found, err
+			}
+			used[next] = false
+			order = order[:len(order)-1]
+		}
+		return false, nil
+	}
+	found, err := extend(0)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errInfeasibleExclusions
+	}
+	var tokens []string
+	for _, i := range order {
+		tokens = append(tokens, chains[i]...)
+	}
+	return tokens, nil
+}
+
+// parseFieldDefs reads the organizer's extra join questions, one label per
+// line. A trailing "*" makes the question required.
+func parseFieldDefs(raw string) ([]FieldDef, error) {
+	var defs []FieldDef
+	keys := make(map[string]bool)
+	for _, line := range strings.Split(raw, "\n") {
+		label := strings.TrimSpace(line)
+		required := strings.HasSuffix(label, "*")
+		label = strings.TrimSpace(strings.TrimSuffix(label, "*"))
+		if label == "" {
+			continue
+		}
+		if utf8.RuneCountInString(label) > maxNameLength {
+			return nil, fmt.Errorf("Questions are too long (max %d characters each)", maxNameLength)
+		}
+		// Keys are slugs of the label, made unique with the question number
+		key := strings.Trim(strings.Map(func(r rune) rune {
+			if unicode.IsLetter(r) || unicode.IsDigit(r) {
+				return unicode.ToLower(r)
+			}
+			return '-'
+		}, label), "-")
+		if key == "" || keys[key] {
+			key = fmt.Sprintf("%s-%d", key, len(defs)+1)
+		}
+		keys[key] = true
+		defs = append(defs, FieldDef{Key: key, Label: label, Required: required, MaxLength: maxFieldLength})
+	}
+	if len(defs) > maxCustomFields {
+		return nil, fmt.Errorf("Too many questions (max %d)", maxCustomFields)
+	}
+	return defs, nil
+}
+
+// parseCustomFields validates a participant's answers to the draw's questions
+func parseCustomFields(r *http.Request, defs []FieldDef) (map[string]string, error) {
+	var fields map[string]string
+	for _, def := range defs {
+		value := strings.TrimSpace(r.FormValue("field_" + def.Key))
+		if value == "" {
+			if def.Required {
+				return nil, fmt.Errorf("%s is required", def.Label)
+			}
+			continue
+		}
+		if utf8.RuneCountInString(value) > def.MaxLength {
+			return nil, fmt.Errorf("%s is too long (max %d characters)", def.Label, def.MaxLength)
+		}
+		if fields == nil {
+			fields = make(map[string]string)
+		}
+		fields[def.Key] = value
+	}
+	return fields, nil
+}
+
+// parseAvoidNames splits the comma-separated names a participant would rather
+// not draw
+func parseAvoidNames(raw string) ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(raw, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if utf8.RuneCountInString(name) > maxNameLength {
+			return nil, fmt.Errorf("Names are too long (max %d characters each)", maxNameLength)
+		}
+		names = append(names, name)
+	}
+	if len(names) > maxAvoidNames {
+		return nil, fmt.Errorf("Too many names to avoid (max %d)", maxAvoidNames)
+	}
+	return names, nil
+}
+
+// assignmentHash returns the SHA-256 of the sorted giver->receiver name pairs
+func assignmentHash(participants map[string]*Participant, assignment map[string]string) string {
+	pairs := make([]string, 0, len(assignment))
+	for giver, receiver := range assignment {
+		pairs = append(pairs, participants[giver].Name+"->"+receiver)
+	}
+	sort.Strings(pairs)
+	sum := sha256.Sum256([]byte(strings.Join(pairs, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// validateInput sanitizes and validates user input
+func validateInput(input string, maxLength int, fieldName string) (string, error) {
+	// Trim whitespace
+	input = strings.TrimSpace(input)
+
+	// Check if empty
+	if input == "" {
+		return "", fmt.Errorf("%s cannot be empty", fieldName)
+	}
+
+	// encoding/json would silently turn invalid bytes into U+FFFD when saving
+	if !utf8.ValidString(input) {
+		return "", fmt.Errorf("%s contains invalid characters", fieldName)
+	}
+
+	// Check length in characters, not bytes, so "Zoë" counts as 3
+	if utf8.RuneCountInString(input) > maxLength {
+		return "", fmt.Errorf("%s is too long (max %d characters)", fieldName, maxLength)
+	}
+
+	return input, nil
+}
+
+// levenshtein returns the edit distance between a and b, counted in runes
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
+
+// similarNames returns the participant names that are close to, but not exactly, name.
+// Note: This function should be called when dataMutex is already locked
+func similarNames(draw *Draw, name string) []string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	similar := []string{}
+	for _, p := range draw.Participants {
+		existing := strings.ToLower(p.Name)
+		d := levenshtein(name, existing)
+		// Require the distance to be smaller than the shorter name so that
+		// short names like "Al" and "Bo" are not reported as similar
+		shortest := min(len([]rune(name)), len([]rune(existing)))
+		if d > 0 && d <= nameSimilarityDistance && d < shortest {
+			similar = append(similar, p.Name)
+		}
+	}
+	sort.Strings(similar)
+	return similar
+}
+
+// stripWishHTML is set from STRIP_WISH_HTML and removes markup from wishes on save
+var stripWishHTML = os.Getenv("STRIP_WISH_HTML") == "true"
+
+var htmlTagPattern = regexp.MustCompile(`<[^>]*>`)
+
+// normalizeWish turns a wish into plain text when STRIP_WISH_HTML is enabled,
+// e.g. "<b>socks</b>" is stored as "socks" instead of being shown escaped
+func normalizeWish(wish string) string {
+	if !stripWishHTML {
+		return wish
+	}
+	return strings.TrimSpace(html.UnescapeString(htmlTagPattern.ReplaceAllString(wish, "")))
+}
+
+// wishKey is the form wishes are compared in for duplicates: trimmed,
+// lowercased and with runs of whitespace collapsed, so "Warm  Socks" and
+// "warm socks " match
+func wishKey(wish string) string {
+	return strings.Join(strings.Fields(strings.ToLower(wish)), " ")
+}
+
+// duplicateWishes returns the tokens of the participants whose wish is the
+// same as someone else's. It only flags them, nobody is stopped from joining.
+// Note: This function should be called when dataMutex is already locked
+func duplicateWishes(d *Draw) map[string]bool {
+	byWish := make(map[string][]string)
+	for t, p := range d.activeParticipants() {
+		if key := wishKey(p.Wish); key != "" {
+			byWish[key] = append(byWish[key], t)
+		}
+	}
+	dups := make(map[string]bool)
+	for _, tokens := range byWish {
+		if len(tokens) > 1 {
+			for _, t := range tokens {
+				dups[t] = true
+			}
+		}
+	}
+	return dups
+}
+
+// parseGiftIdeas splits the "other ideas" field into one idea per line,
+// dropping blank lines and enforcing the count and length limits
+func parseGiftIdeas(raw string) ([]string, error) {
+	var ideas []string
+	for _, line := range strings.Split(raw, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if utf8.RuneCountInString(line) > maxGiftIdeaLen {
+			return nil, fmt.Errorf("Gift ideas are too long (max %d characters each)", maxGiftIdeaLen)
+		}
+		ideas = append(ideas, line)
+	}
+	if len(ideas) > maxGiftIdeas {
+		return nil, fmt.Errorf("Too many gift ideas (max %d)", maxGiftIdeas)
+	}
+	return ideas, nil
+}
+
+// minNameLength (MIN_NAME_LENGTH) and nameRequireLetter (NAME_REQUIRE_LETTER)
+// tighten the name rules so names like "." or "123" can be rejected
+var (
+	minNameLength     = envInt("MIN_NAME_LENGTH", 1)
+	nameRequireLetter = os.Getenv("NAME_REQUIRE_LETTER") == "true"
+)
+
+// checkNameRules applies the configurable name rules to an already validated
+// draw or participant name. It returns the error code to report, or "".
+func checkNameRules(name string) string {
+	if utf8.RuneCountInString(name) < minNameLength {
+		return "name_too_short"
+	}
+	if nameRequireLetter && !strings.ContainsFunc(name, unicode.IsLetter) {
+		return "name_needs_letter"
+	}
+	return ""
+}
+
+// writeNameError reports a checkNameRules failure
+func writeNameError(w http.ResponseWriter, r *http.Request, code string) {
+	writeError(w, r, http.StatusBadRequest, code, "{min}", strconv.Itoa(minNameLength))
+}
+
+// apiError is the JSON body returned to API clients when a request fails
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// wantsJSON reports whether the client asked for a JSON response
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// writeJSON encodes v as the JSON response body
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError sends a localized error message to browsers and a JSON error
+// object to API clients. The message is looked up as "error_<code>", and
+// replacements are placeholder/value pairs such as "{min}", "2".
+func writeError(w http.ResponseWriter, r *http.Request, status int, code string, replacements ...string) {
+	t := loadTranslations(getLanguage(r))
+	message, ok := t.lookup("error_" + code)
+	if !ok {
+		message = http.StatusText(status)
+	}
+	message = strings.NewReplacer(replacements...).Replace(message)
+
+	if wantsJSON(r) {
+		writeJSON(w, status, apiError{Code: code, Message: message})
+		return
+	}
+	http.Error(w, message, status)
+}
+
+func main() {
+	// Flags win over environment variables: PORT only sets the default of --port
+	port := flag.Int("port", envInt("PORT", 8080), "port to listen on (default $PORT, then 8080)")
+	flag.StringVar(&dataFile, "data-file", dataFile, "path to the data file")
+	showVersion := flag.Bool("version", false, "print the version and exit")
+	flag.Parse()
+	if *showVersion {
+		fmt.Println(version)
+		return
+	}
+
+	// Also catches log.Printf, which goes through the default slog handler
+	slog.SetDefault(slog.New(NewRedactingHandler(slog.NewTextHandler(os.Stderr, nil))))
+
+	loadData()
+
+	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
+
+	// Serve robots.txt and sitemap.xml at the site root to aid crawlers
+	http.HandleFunc("/robots.txt", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "static/robots.txt")
+	})
+	http.HandleFunc("/sitemap.xml", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "static/sitemap.xml")
+	})
+
+	http.HandleFunc("/", homeHandler)
+	http.HandleFunc("/draw/create", createDrawHandler)
+	http.HandleFunc("/draw/", drawHandler)
+	http.HandleFunc("/s/", shortLinkHandler)
+	http.HandleFunc("/join", joinCodeHandler)
+	http.HandleFunc("/admin/", adminHandler)
+	http.HandleFunc("/healthz", healthHandler)
+	http.HandleFunc("/version", versionHandler)
+	http.HandleFunc("/healthz/detailed", healthDetailedHandler)
+
+	fmt.Printf("Server started at http://localhost:%d\n", *port)
+
+	mux := http.DefaultServeMux
+
+	// forceHTTPS redirects HTTP -> HTTPS for non-local requests using a 301.
+	// We intentionally allow localhost and private/local IP ranges to remain on HTTP for local dev.
+	forceHTTPS := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !isHTTPS(r) && !isLocalHost(r.Host) {
+				// Redirect to the canonical page directly to avoid an intermediate root redirect.
+				destination := "https://" + r.Host + r.URL.RequestURI()
+				if r.URL.Path == "/" {
+					destination = "https://" + r.Host + "/draw/create"
+				}
+				http.Redirect(w, r, destination, http.StatusMovedPermanently)
+				return
+			}
+			// Add HSTS header for secure responses to enforce HTTPS
+			if isHTTPS(r) && !isLocalHost(r.Host) {
+				w.Header().Set("Strict-Transport-Security", "max-age=63072000; includeSubDomains; preload")
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+
+	var handler http.Handler = mux
+	if dryRunMode {
+		// Let clients tell they're talking to a server that keeps nothing
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Dry-Run", "true")
+			mux.ServeHTTP(w, r)
+		})
+	}
+	handler = limitConcurrency(forceHTTPS(handler), envInt("MAX_CONCURRENT_REQUESTS", 100))
+	handler = limitConcurrencyPerIP(handler, envLimit("MAX_CONCURRENT_REQUESTS_PER_IP", 10))
+	handler = logSlowRequests(handler, envDuration("SLOW_REQUEST_THRESHOLD", 2*time.Second))
+
+	log.Fatal(http.ListenAndServe(":"+strconv.Itoa(*port), handler))
+}
+
+// unlimitedRequest reports whether r bypasses the concurrency limits. Draw
+// event streams stay open for as long as the page does, they have their own
+// caps (maxStreamsPerDraw, maxStreamsPerIP) instead of holding a slot. The
+// plain health check must answer even when the server is saturated.
+func unlimitedRequest(r *http.Request) bool {
+	if r.URL.Path == "/healthz" {
+		return true
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/draw/"), "/")
+	return strings.HasPrefix(r.URL.Path, "/draw/") && len(parts) == 2 && parts[0] != "" && parts[1] == "events"
+}
+
+// limitConcurrencyPerIP allows each client IP at most limit requests in flight,
+// so a few clients holding slow connections can't take every slot of
+// limitConcurrency. Excess requests get a 503 right away. 0 disables the limit.
+func limitConcurrencyPerIP(next http.Handler, limit int) http.Handler {
+	if limit <= 0 {
+		return next
+	}
+	var mu sync.Mutex
+	inFlight := make(map[string]int)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if unlimitedRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ip := clientIP(r)
+		mu.Lock()
+		if inFlight[ip] >= limit {
+			mu.Unlock()
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Too many requests at once. Please try again in a moment.", http.StatusServiceUnavailable)
+			return
+		}
+		inFlight[ip]++
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			if inFlight[ip]--; inFlight[ip] == 0 {
+				delete(inFlight, ip)
+			}
+			mu.Unlock()
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// concurrencyWait is how long a request waits for a slot in limitConcurrency
+var concurrencyWait = 5 * time.Second
+
+// limitConcurrency allows at most limit requests in flight. Requests that cannot
+// get a slot within concurrencyWait are rejected with a 503 so a burst of
+// visitors doesn't pile up behind dataMutex.
+func limitConcurrency(next http.Handler, limit int) http.Handler {
+	semaphore := make(chan struct{}, limit)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if unlimitedRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		timer := time.NewTimer(concurrencyWait)
+		defer timer.Stop()
+
+		select {
+		case semaphore <- struct{}{}:
+		case <-timer.C:
+			w.Header().Set("Retry-After", "5")
+			http.Error(w, "Server is busy. Please try again in a few seconds.", http.StatusServiceUnavailable)
+			return
+		case <-r.Context().Done():
+			return
+		}
+		// Released in a defer so a panicking handler doesn't leak its slot
+		defer func() { <-semaphore }()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// drawSlots bounds the shuffles running at once (MAX_CONCURRENT_DRAWS). With pins
+// and exclusions a shuffle can retry maxShuffleAttempts times and then search,
+// it runs on a snapshot outside dataMutex so this is what keeps the CPU in check.
+var drawSlots = make(chan struct{}, max(envInt("MAX_CONCURRENT_DRAWS", 4), 1))
+
+// acquireDrawSlot takes a slot in drawSlots without waiting. When all are busy it
+// answers 503 and returns false, otherwise the caller must call releaseDrawSlot.
+func acquireDrawSlot(w http.ResponseWriter) bool {
+	select {
+	case drawSlots <- struct{}{}:
+		return true
+	default:
+		w.Header().Set("Retry-After", "2")
+		http.Error(w, "Too many draws in progress. Please try again in a few seconds.", http.StatusServiceUnavailable)
+		return false
+	}
+}
+
+func releaseDrawSlot() {
+	<-drawSlots
+}
+
+// logSlowRequests logs requests that take longer than threshold. Only the route
+// template is logged, never draw IDs, tokens or form values.
+func logSlowRequests(next http.Handler, threshold time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		next.ServeHTTP(w, r)
+		elapsed := time.Since(start)
+
+		// Event streams are expected to stay open
+		if elapsed > threshold && !strings.HasSuffix(r.URL.Path, "/events") {
+			slog.Warn("slow request",
+				"method", r.Method,
+				"route", routeTemplate(r.URL.Path),
+				"duration", elapsed.Round(time.Millisecond).String())
+		}
+	})
+}
+
+// tokenPattern matches tokens from generateSecureToken anywhere in a string
+var tokenPattern = regexp.MustCompile(`[0-9a-f]{32}`)
+
+// RedactingHandler replaces anything that looks like a token in the message and
+// attributes of a log record with [REDACTED], so a logged URL can't leak a
+// participant or organizer link. Draw IDs have the same shape and are redacted too.
+type RedactingHandler struct {
+	next slog.Handler
+}
+
+// NewRedactingHandler wraps next, which receives the redacted records
+func NewRedactingHandler(next slog.Handler) *RedactingHandler {
+	return &RedactingHandler{next: next}
+}
+
+func (h *RedactingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *RedactingHandler) Handle(ctx context.Context, record slog.Record) error {
+	redacted := slog.NewRecord(record.Time, record.Level, redactTokens(record.Message), record.PC)
+	record.Attrs(func(a slog.Attr) bool {
+		redacted.AddAttrs(redactAttr(a))
+		return true
+	})
+	return h.next.Handle(ctx, redacted)
+}
+
+func (h *RedactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redacted[i] = redactAttr(a)
+	}
+	return &RedactingHandler{next: h.next.WithAttrs(redacted)}
+}
+
+func (h *RedactingHandler) WithGroup(name string) slog.Handler {
+	return &RedactingHandler{next: h.next.WithGroup(name)}
+}
+
+// redactAttr redacts string values, groups recursively, and any other value
+// whose text form contains a token, e.g. a *url.URL
+func redactAttr(a slog.Attr) slog.Attr {
+	a.Value = a.Value.Resolve()
+	switch a.Value.Kind() {
+	case slog.KindString:
+		a.Value = slog.StringValue(redactTokens(a.Value.String()))
+	case slog.KindGroup:
+		group := a.Value.Group()
+		redacted := make([]slog.Attr, len(group))
+		for i, ga := range group {
+			redacted[i] = redactAttr(ga)
+		}
+		a.Value = slog.GroupValue(redacted...)
+	case slog.KindAny:
+		if text := fmt.Sprint(a.Value.Any()); tokenPattern.MatchString(text) {
+			a.Value = slog.StringValue(redactTokens(text))
+		}
+	}
+	return a
+}
+
+func redactTokens(s string) string {
+	return tokenPattern.ReplaceAllString(s, "[REDACTED]")
+}
+
+// routeTemplate replaces draw IDs and tokens in a path with placeholders,
+// e.g. /draw/3fa8.../participant/9c1e... -> /draw/{id}/participant/{token}
+func routeTemplate(path string) string {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	for i, part := range parts {
+		switch {
+		case i == 1 && parts[0] == "draw" && part != "create":
+			parts[i] = "{id}"
+		case i == 2 && parts[0] == "admin" && parts[1] == "draws":
+			parts[i] = "{id}"
+		case isToken(part):
+			parts[i] = "{token}"
+		}
+	}
+	return "/" + strings.Join(parts, "/")
+}
+
+// isToken reports whether s looks like a token from generateSecureToken
+func isToken(s string) bool {
+	if len(s) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// corsAllowedOrigins is the set of origins from CORS_ALLOWED_ORIGINS (comma separated)
+// that may call the JSON endpoints from the browser. Wildcards are not supported.
+var corsAllowedOrigins = loadAllowedOrigins()
+
+// jsonRoutes are the draw actions that serve JSON and get CORS headers.
+// HTML pages and form posts are never exposed cross-origin.
+var jsonRoutes = map[string]bool{
+	"join-count": true,
+	"name-check": true,
+	"status":     true,
+	"ttl":        true,
+}
+
+func loadAllowedOrigins() map[string]bool {
+	origins := make(map[string]bool)
+	for _, origin := range strings.Split(os.Getenv("CORS_ALLOWED_ORIGINS"), ",") {
+		origin = strings.TrimRight(strings.TrimSpace(origin), "/")
+		if origin != "" && origin != "*" {
+			origins[origin] = true
+		}
+	}
+	return origins
+}
+
+// handleCORS adds CORS headers for allowed origins and answers preflight requests.
+// It returns true when the request has been fully handled.
+func handleCORS(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	w.Header().Add("Vary", "Origin")
+	if origin == "" || !corsAllowedOrigins[origin] {
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusForbidden)
+			return true
+		}
+		return false
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, If-None-Match")
+		w.Header().Set("Access-Control-Max-Age", "600")
+		w.WriteHeader(http.StatusNoContent)
+		return true
+	}
+	return false
+}
+
+// envDuration reads a duration such as "500ms" from the environment, falling back to def
+func envDuration(name string, def time.Duration) time.Duration {
+	if v, err := time.ParseDuration(os.Getenv(name)); err == nil && v > 0 {
+		return v
+	}
+	return def
+}
+
+// envInt reads a positive integer from the environment, falling back to def
+func envInt(name string, def int) int {
+	if v, err := strconv.Atoi(os.Getenv(name)); err == nil && v > 0 {
+		return v
+	}
+	return def
+}
+
+// envLimit is envInt for limits that 0 turns off: it also accepts 0
+func envLimit(name string, def int) int {
+	if v, err := strconv.Atoi(os.Getenv(name)); err == nil && v >= 0 {
+		return v
+	}
+	return def
+}
+
+// isLocalHost returns true for localhost, loopback and common private IP ranges.
+func isLocalHost(hostport string) bool {
+	host := hostport
+	if h, _, err := net.SplitHostPort(hostport); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() {
+		return true
+	}
+	// Check common private and local ranges using CIDRs
+	cidrs := []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7", "fe80::/10"}
+	for _, c := range cidrs {
+		_, netw, _ := net.ParseCIDR(c)
+		if netw != nil && netw.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func isHTTPS(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	proto := r.Header.Get("X-Forwarded-Proto")
+	if strings.EqualFold(proto, "https") {
+		return true
+	}
+	return false
+}
+
+// dryRunMode (DRY_RUN=true) runs every handler normally but never reads or
+// writes the data file, for integration tests in CI
+var dryRunMode = os.Getenv("DRY_RUN") == "true"
+
+func loadData() {
+	dataMutex.Lock()
+	defer dataMutex.Unlock()
+
+	if dryRunMode {
+		log.Printf("DRY_RUN: starting with empty data, %s is not read or written", dataFile)
+		appData.Events = make(map[string]*Draw)
+		return
+	}
+
+	path := dataFile
+	if os.Getenv("RESTORE_BACKUP") == "true" {
+		// Recover from a bad write by starting from the most recent backup
+		if backups := listBackups(); len(backups) > 0 {
+			path = backups[len(backups)-1]
+			log.Printf("RESTORE_BACKUP: loading %s", path)
+		} else {
+			log.Printf("RESTORE_BACKUP: no backup found in %s, loading %s", backupDir(), dataFile)
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		fmt.Println("Data file not found, creating new one.")
+		appData.Events = make(map[string]*Draw)
+		return
+	}
+	defer file.Close()
+
+	bytes, err := io.ReadAll(file)
+	if err != nil {
+		setAsideDataFile(path, fmt.Errorf("reading: %w", err))
+		return
+	}
+
+	if err := json.Unmarshal(bytes, &appData); err != nil {
+		setAsideDataFile(path, fmt.Errorf("parsing: %w", err))
+		return
+	}
+	verifyChecksum(bytes)
+	prepareDraws()
+
+	cleanupOldEvents()
+	indexTags()
+}
+
+// prepareDraws sets up the fields of freshly loaded draws that aren't stored
+// Note: This function should be called when dataMutex is already locked
+func prepareDraws() {
+	for _, draw := range appData.Events {
+		draw.participantCount.Store(int32(len(draw.activeParticipants())))
+		// Draws hidden before CodenamesIssued existed: continue after the highest number in use
+		if draw.OriginalNames != nil && draw.CodenamesIssued == 0 {
+			for token := range draw.OriginalNames {
+				if p, ok := draw.Participants[token]; ok {
+					if _, n, found := strings.Cut(p.Name, " #"); found {
+						if number, err := strconv.Atoi(n); err == nil && number > draw.CodenamesIssued {
+							draw.CodenamesIssued = number
+						}
+					}
+				}
+			}
+		}
+		// Draws done before DrawnAt existed: their last successful shuffle is the best guess
+		if draw.DrawDone && draw.DrawnAt == nil {
+			for _, record := range draw.ShuffleHistory {
+				if record.Succeeded {
+					drawnAt := record.AttemptedAt
+					draw.DrawnAt = &drawnAt
+				}
+			}
+		}
+	}
+}
+
+// tagIndex maps each tag to the IDs of the draws carrying it, so filtering by
+// tag doesn't scan every draw. Guarded by dataMutex.
+var tagIndex = make(map[string]map[string]bool)
+
+// indexTags rebuilds tagIndex from appData
+// Note: This function should be called when dataMutex is already locked
+func indexTags() {
+	tagIndex = make(map[string]map[string]bool)
+	for id, draw := range appData.Events {
+		for _, tag := range draw.Tags {
+			if tagIndex[tag] == nil {
+				tagIndex[tag] = make(map[string]bool)
+			}
+			tagIndex[tag][id] = true
+		}
+	}
+}
+
+// setTags replaces the tags of a draw and keeps tagIndex up to date
+// Note: This function should be called when dataMutex is already locked
+func setTags(id string, draw *Draw, tags []string) {
+	for _, tag := range draw.Tags {
+		delete(tagIndex[tag], id)
+		if len(tagIndex[tag]) == 0 {
+			delete(tagIndex, tag)
+		}
+	}
+	draw.Tags = tags
+	for _, tag := range tags {
+		if tagIndex[tag] == nil {
+			tagIndex[tag] = make(map[string]bool)
+		}
+		tagIndex[tag][id] = true
+	}
+}
+
+// normalizeTags parses comma-separated tags, lowercased and limited to ASCII
+// letters, digits and hyphens. Duplicates and empty tags are dropped.
+func normalizeTags(raw string) ([]string, error) {
+	var tags []string
+	for _, tag := range strings.Split(raw, ",") {
+		tag = strings.Map(func(r rune) rune {
+			r = unicode.ToLower(r)
+			if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '-' {
+				return r
+			}
+			return -1
+		}, tag)
+		if tag == "" || slices.Contains(tags, tag) {
+			continue
+		}
+		if len(tag) > maxTagLength {
+			return nil, fmt.Errorf("Tags are too long (max %d characters each)", maxTagLength)
+		}
+		tags = append(tags, tag)
+	}
+	if len(tags) > maxTags {
+		return nil, fmt.Errorf("Too many tags (max %d)", maxTags)
+	}
+	return tags, nil
+}
+
+// setAsideDataFile handles a data file that can't be loaded. With
+// STRICT_LOAD=true the server refuses to start. Otherwise the file is renamed
+// with a timestamp, so the next save can't overwrite it, and the server starts
+// with no draws.
+// Note: This function should be called when dataMutex is already locked
+func setAsideDataFile(path string, loadErr error) {
+	if os.Getenv("STRICT_LOAD") == "true" {
+		log.Fatalf("Error loading %s: %v. Refusing to start (STRICT_LOAD=true).", path, loadErr)
+	}
+	corrupt := path + ".corrupt." + timeNow().UTC().Format("20060102T150405")
+	if err := os.Rename(path, corrupt); err != nil {
+		log.Fatalf("Error loading %s: %v. It could not be set aside either (%v), refusing to start so it isn't overwritten.", path, loadErr, err)
+	}
+	log.Printf("ERROR: could not load %s: %v", path, loadErr)
+	log.Printf("ERROR: the file was moved to %s and the server starts with NO DRAWS. Fix it and restore it by hand.", corrupt)
+	appData = Data{Events: make(map[string]*Draw)}
+}
+
+// verifyChecksum warns when the data file was modified outside of the app, e.g.
+// edited by hand or written by another instance sharing the file. With
+// STRICT_CHECKSUM=true the server refuses to start instead.
+// It checks the bytes read from the file, before anything migrates them.
+func verifyChecksum(raw []byte) {
+	stored, sum := fileChecksum(raw)
+	if stored == "" {
+		log.Printf("Data file has no checksum, it will be added on the next save")
+		return
+	}
+	if sum == stored {
+		return
+	}
+	if os.Getenv("STRICT_CHECKSUM") == "true" {
+		log.Fatalf("Data file checksum mismatch: %s was modified outside of the app", dataFile)
+	}
+	log.Printf("WARNING: data file checksum mismatch, %s was modified outside of the app. Continuing with its content.", dataFile)
+}
+
+// fileChecksum returns the checksum stored in the data file content raw and the
+// one computed from it. The checksum covers the bytes of "events" exactly as
+// they are in the file, so a later change to Draw doesn't invalidate files
+// written before it.
+func fileChecksum(raw []byte) (stored, sum string) {
+	var file struct {
+		Events   json.RawMessage `json:"events"`
+		Checksum string          `json:"checksum"`
+	}
+	if err := json.Unmarshal(raw, &file); err != nil {
+		return "", ""
+	}
+	return file.Checksum, sha256Hex(file.Events)
+}
+
+// sha256Hex returns the hex-encoded SHA-256 of data
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// retentionDays is how long a draw is kept after its creation, from RETENTION_DAYS
+var retentionDays = envInt("RETENTION_DAYS", 30)
+
+// doneRetentionDays replaces retentionDays for draws that were done, from
+// RETENTION_DAYS_DONE. Organizers may come back to those to check who gave what.
+var doneRetentionDays = envInt("RETENTION_DAYS_DONE", retentionDays)
+
+// retentionFor returns how many days the draw is kept after its creation
+func retentionFor(draw *Draw) int {
+	if draw.DrawDone {
+		return doneRetentionDays
+	}
+	return retentionDays
+}
+
+// deleteAt returns when a draw becomes eligible for cleanup
+func deleteAt(draw *Draw) time.Time {
+	return draw.CreatedAt.AddDate(0, 0, retentionFor(draw))
+}
+
+// cleanupOldEvents removes draws older than the retention period
+// Note: This function should be called when dataMutex is already locked
+func cleanupOldEvents() {
+	now := timeNow()
+	deleted := 0
+	for id, draw := range appData.Events {
+		if deleteAt(draw).Before(now) {
+			delete(appData.Events, id)
+			deleted++
+		}
+	}
+	if deleted > 0 {
+		fmt.Printf("Cleaned up %d old draws (older than %d days, %d once done)\n", deleted, retentionDays, doneRetentionDays)
+		saveDataUnsafe()
+	}
+}
+
+func saveData() {
+	dataMutex.Lock()
+	defer dataMutex.Unlock()
+	saveDataUnsafe()
+}
+
+// saveDataUnsafe saves data without acquiring the mutex (for when already locked)
+func saveDataUnsafe() {
+	if dryRunMode {
+		log.Printf("DRY_RUN: would save %d draws", len(appData.Events))
+		return
+	}
+	// Laid out like json.MarshalIndent(appData, "", "  ") would, with the
+	// checksum computed over the "events" bytes that end up in the file
+	events, err := json.MarshalIndent(appData.Events, "  ", "  ")
+	if err != nil {
+		log.Printf("Error marshaling data: %v", err)
+		return
+	}
+	appData.Checksum = sha256Hex(events)
+	bytes := []byte(fmt.Sprintf("{\n  \"events\": %s,\n  \"checksum\": %q\n}", events, appData.Checksum))
+
+	if os.Getenv("BACKUP_ON_WRITE") == "true" {
+		if err := backupDataFile(); err != nil {
+			log.Printf("Error backing up data file: %v", err)
+		}
+	}
+
+	if err := os.WriteFile(dataFile, bytes, 0644); err != nil {
+		log.Printf("Error writing data file: %v", err)
+		return
+	}
+	lastSaveAt = timeNow()
+}
+
+// lastSaveAt is when the data file was last written successfully. Guarded by dataMutex.
+var lastSaveAt time.Time
+
+// backupDir is where data file backups are kept, BACKUP_DIR or next to the data file
+func backupDir() string {
+	if dir := os.Getenv("BACKUP_DIR"); dir != "" {
+		return dir
+	}
+	return filepath.Dir(dataFile)
+}
+
+// backupPrefix starts the name of every backup, followed by a sortable timestamp
+func backupPrefix() string {
+	return filepath.Base(dataFile) + ".bak."
+}
+
+// backupDataFile copies the current data file to {BACKUP_DIR}/data.json.bak.{timestamp}
+// before it gets overwritten, then prunes backups beyond BACKUP_RETAIN_COUNT.
+// The copy is written to a temporary file and renamed so a backup is never partial.
+func backupDataFile() error {
+	current, err := os.ReadFile(dataFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	dir := backupDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, ".backup-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+	if _, err := tmp.Write(current); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	name := backupPrefix() + timeNow().UTC().Format("20060102T150405.000000000")
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, name)); err != nil {
+		return err
+	}
+
+	backups := listBackups()
+	for len(backups) > envInt("BACKUP_RETAIN_COUNT", 5) {
+		os.Remove(backups[0])
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// listBackups returns the paths of the data file backups, oldest first
+func listBackups() []string {
+	matches, _ := filepath.Glob(filepath.Join(backupDir(), backupPrefix()+"*"))
+	sort.Strings(matches)
+	return matches
+}
+
+func getLanguage(r *http.Request) string {
+	// Check query parameter first (for manual override), ignoring unknown ones
+	lang := r.URL.Query().Get("lang")
+	if slices.Contains(supportedLanguages, lang) {
+		return lang
+	}
+
+	// Parse Accept-Language header
+	acceptLang := r.Header.Get("Accept-Language")
+	if acceptLang != "" {
+		// Accept-Language format: "en-US,en;q=0.9,fr;q=0.8"
+		langs := parseAcceptLanguage(acceptLang)
+		for _, l := range langs {
+			// Check if we support this language
+			if slices.Contains(supportedLanguages, l) {
+				return l
+			}
+		}
+	}
+
+	// Default to English
+	return "en"
+}
+
+// drawLanguage picks the language of a draw's pages: a supported ?lang= first,
+// then the draw's Locale, then the visitor's Accept-Language
+func drawLanguage(r *http.Request, draw *Draw) string {
+	if draw.Locale != "" && !slices.Contains(supportedLanguages, r.URL.Query().Get("lang")) {
+		return draw.Locale
+	}
+	return getLanguage(r)
+}
+
+func parseAcceptLanguage(header string) []string {
+	var langs []string
+	for _, part := range splitByComma(header) {
+		// Split by semicolon to remove quality values (;q=0.9)
+		langPart := part
+		if idx := indexByte(part, ';'); idx != -1 {
+			langPart = part[:idx]
+		}
+		// Trim spaces and extract base language (en-US -> en)
+		langPart = trimSpace(langPart)
+		if idx := indexByte(langPart, '-'); idx != -1 {
+			langPart = langPart[:idx]
+		}
+		if langPart != "" {
+			langs = append(langs, langPart)
+		}
+	}
+	return langs
+}
+
+func splitByComma(s string) []string {
+	var result []string
+	start := 0
+	for i := 0; i < len(s); i++ {
+		if s[i] == ',' {
+			result = append(result, s[start:i])
+			start = i + 1
 		}
 	}
 	result = append(result, s[start:])
 	return result
 }
 
-func indexByte(s string, c byte) int {
-	for i := 0; i < len(s); i++ {
-		if s[i] == c {
-			return i
+func indexByte(s string, c byte) int {
+	for i := 0; i < len(s); i++ {
+		if s[i] == c {
+			return i
+		}
+	}
+	return -1
+}
+
+func trimSpace(s string) string {
+	start := 0
+	end := len(s)
+	for start < end && (s[start] == ' ' || s[start] == '\t') {
+		start++
+	}
+	for end > start && (s[end-1] == ' ' || s[end-1] == '\t') {
+		end--
+	}
+	return s[start:end]
+}
+
+// readLocale reads the strings of one language, nil if there is no such locale
+func readLocale(lang string) map[string]string {
+	bytes, err := os.ReadFile(fmt.Sprintf("locales/%s.json", lang))
+	if err != nil {
+		return nil
+	}
+	var translations map[string]string
+	json.Unmarshal(bytes, &translations)
+	return translations
+}
+
+func loadTranslations(lang string) Translations {
+	if lang == "" {
+		lang = "en"
+	}
+	t := Translations{primary: readLocale(lang)}
+	if lang != "en" {
+		t.fallback = readLocale("en")
+	}
+	return t
+}
+
+func homeHandler(w http.ResponseWriter, r *http.Request) {
+	lang := getLanguage(r)
+	t := loadTranslations(lang)
+	canonical := fmt.Sprintf("https://%s/", r.Host)
+	render(w, r, "create_event.html", struct {
+		T              Translations
+		CurrentLang    string
+		Canonical      string
+		Constraints    Constraints
+		IdempotencyKey string
+	}{t, lang, canonical, formConstraints, generateSecureToken()})
+}
+
+// recentCreates remembers the manage URL of draws created with an idempotency
+// key, so a double-submitted create form doesn't make a second draw. Keys are
+// scoped to the client's hashed IP. Guarded by dataMutex.
+var recentCreates = make(map[string]recentCreate)
+
+const idempotencyWindow = 2 * time.Minute
+
+type recentCreate struct {
+	URL string
+	At  time.Time
+}
+
+// idempotencyKey returns the key a create request was sent with, from the
+// Idempotency-Key header or the form, scoped to the client
+func idempotencyKey(r *http.Request) string {
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" {
+		key = r.FormValue("idempotencykey")
+	}
+	if key == "" || len(key) > 100 {
+		return ""
+	}
+	return hashIP(clientIP(r)) + ":" + key
+}
+
+// recentCreateURL returns the manage URL of the draw created with key within
+// idempotencyWindow, if any
+func recentCreateURL(key string) (string, bool) {
+	if key == "" {
+		return "", false
+	}
+	dataMutex.RLock()
+	defer dataMutex.RUnlock()
+	c, ok := recentCreates[key]
+	if !ok || timeNow().Sub(c.At) > idempotencyWindow {
+		return "", false
+	}
+	return c.URL, true
+}
+
+// createLimiter caps how many draws one IP address can create per minute
+// (CREATE_RATE_LIMIT, 0 disables it)
+var createLimiter = ratelimit.New(envLimit("CREATE_RATE_LIMIT", 10), time.Minute)
+
+func createDrawHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		// Redirect to root - content is served at /
+		http.Redirect(w, r, "/", http.StatusMovedPermanently)
+		return
+	}
+	if creationDisabled() {
+		writeError(w, r, http.StatusServiceUnavailable, "read_only")
+		return
+	}
+	// A resubmitted form is answered before the rate limit, it creates nothing
+	key := idempotencyKey(r)
+	if existing, ok := recentCreateURL(key); ok {
+		http.Redirect(w, r, existing, http.StatusSeeOther)
+		return
+	}
+	if !createLimiter.Allow(clientIP(r)) {
+		w.Header().Set("Retry-After", "60")
+		writeError(w, r, http.StatusTooManyRequests, "rate_limited")
+		return
+	}
+	r.ParseForm()
+	eventName := r.FormValue("eventname")
+	organizerName := r.FormValue("organizername")
+	organizerWish := normalizeWish(r.FormValue("organizerwish"))
+	// The organizer may fill in their wish later from their participant page
+	organizerWishLater := r.FormValue("organizerwishlater") == "on"
+	organizerIdeas := r.FormValue("organizerideas")
+	maxWishStr := strings.TrimSpace(r.FormValue("maxwishlength"))
+	expected := r.FormValue("expected")
+	nameSimilarityCheck := r.FormValue("namesimilarity") == "on"
+	surpriseReveal := r.FormValue("surprisereveal") == "on"
+	requireWishes := r.FormValue("requirewishes") == "on"
+	noNameNeighbors := r.FormValue("nonameneighbors") == "on"
+	publicNames := r.FormValue("publicnames") == "on"
+	flagDuplicateWishes := r.FormValue("flagduplicatewishes") == "on"
+	approvalRequired := r.FormValue("approvalrequired") == "on"
+	customFields := r.FormValue("customfields")
+	rawTags := r.FormValue("tags")
+	locale := r.FormValue("locale")
+
+	// Validate inputs
+	eventName, err := validateInput(eventName, maxNameLength, "Draw name")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if code := checkNameRules(eventName); code != "" {
+		writeNameError(w, r, code)
+		return
+	}
+
+	organizerName, err = validateInput(organizerName, maxNameLength, "Organizer name")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if code := checkNameRules(organizerName); code != "" {
+		writeNameError(w, r, code)
+		return
+	}
+
+	// Optional per-draw wish length, bounded by maxWishCeiling
+	var maxWish *int
+	wishLimit := maxWishLength
+	if maxWishStr != "" {
+		n, err := strconv.Atoi(maxWishStr)
+		if err != nil || n < 1 || n > maxWishCeiling {
+			http.Error(w, fmt.Sprintf("Maximum wish length must be between 1 and %d", maxWishCeiling), http.StatusBadRequest)
+			return
+		}
+		maxWish = &n
+		wishLimit = n
+	}
+
+	// Wish is optional but has max length if provided
+	if organizerWish != "" {
+		if utf8.RuneCountInString(organizerWish) > wishLimit {
+			http.Error(w, fmt.Sprintf("Wish is too long (max %d characters)", wishLimit), http.StatusBadRequest)
+			return
+		}
+	}
+
+	organizerGiftIdeas, err := parseGiftIdeas(organizerIdeas)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	fieldDefs, err := parseFieldDefs(customFields)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tags, err := normalizeTags(rawTags)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Empty lets every visitor see the draw in their own language
+	if locale != "" && !slices.Contains(supportedLanguages, locale) {
+		http.Error(w, "Unsupported language", http.StatusBadRequest)
+		return
+	}
+
+	// Validate expected participants
+	expectedNum := 0
+	fmt.Sscanf(expected, "%d", &expectedNum)
+	if expectedNum < minParticipants || expectedNum > maxParticipants {
+		http.Error(w, fmt.Sprintf("Expected participants must be between %d and %d", minParticipants, maxParticipants), http.StatusBadRequest)
+		return
+	}
+	if noNameNeighbors && expectedNum < minNeighborFreeParticipants {
+		http.Error(w, fmt.Sprintf("Skipping alphabetical neighbors needs at least %d participants", minNeighborFreeParticipants), http.StatusBadRequest)
+		return
+	}
+
+	// Check if we've hit the max active events limit
+	dataMutex.RLock()
+	activeEvents := len(appData.Events)
+	dataMutex.RUnlock()
+
+	if activeEvents >= maxActiveEvents {
+		http.Error(w, "Server is at capacity. Please try again later.", http.StatusServiceUnavailable)
+		return
+	}
+
+	id := generateSecureToken()
+	organizerToken := generateSecureToken()
+	manageURL := "/draw/" + id + "/manage?organizer=" + organizerToken
+
+	dataMutex.Lock()
+	for k, c := range recentCreates {
+		if timeNow().Sub(c.At) > idempotencyWindow {
+			delete(recentCreates, k)
+		}
+	}
+	if c, ok := recentCreates[key]; ok && key != "" {
+		// Same form submitted again while the first was being created
+		dataMutex.Unlock()
+		http.Redirect(w, r, c.URL, http.StatusSeeOther)
+		return
+	}
+	if key != "" {
+		recentCreates[key] = recentCreate{URL: manageURL, At: timeNow()}
+	}
+	draw := &Draw{
+		Name:                 eventName,
+		ExpectedParticipants: &expectedNum,
+		Participants: map[string]*Participant{
+			organizerToken: {
+				Name:      organizerName,
+				Wish:      organizerWish,
+				GiftIdeas: organizerGiftIdeas,
+				Submitted: !organizerWishLater,
+				JoinedAt:  timeNow(),
+				Language:  getLanguage(r),
+				IPHash:    hashIP(clientIP(r)),
+			},
+		},
+		DrawDone:               false,
+		CreatedAt:              timeNow(),
+		NameSimilarityCheck:    nameSimilarityCheck,
+		SurpriseReveal:         surpriseReveal,
+		RequireWishes:          requireWishes,
+		NoNameNeighbors:        noNameNeighbors,
+		PublicNames:            publicNames,
+		FlagDuplicateWishes:    flagDuplicateWishes,
+		ApprovalRequired:       approvalRequired,
+		CustomFieldDefinitions: fieldDefs,
+		CreatedByIP:            hashIP(clientIP(r)),
+		OrganizerToken:         organizerToken,
+		MaxWishLength:          maxWish,
+		ShortID:                uniqueShortID(),
+		JoinCode:               uniqueJoinCode(),
+		Locale:                 locale,
+	}
+	if joinURLTTL > 0 {
+		expiresAt := draw.CreatedAt.Add(joinURLTTL)
+		draw.JoinExpiresAt = &expiresAt
+	}
+	draw.participantCount.Store(1)
+	appData.Events[id] = draw
+	setTags(id, draw, tags)
+	dataMutex.Unlock()
+	saveData()
+
+	// Redirect to manage page with organizer's participant token in query
+	http.Redirect(w, r, manageURL, http.StatusSeeOther)
+}
+
+func drawHandler(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path[len("/draw/"):] // /{id}/...
+
+	// Extract draw ID (everything before the first slash or the whole string)
+	var id string
+	slashIndex := strings.Index(path, "/")
+	if slashIndex == -1 {
+		id = path
+	} else {
+		id = path[:slashIndex]
+	}
+
+	if id == "mine" {
+		if handleCORS(w, r) {
+			return
+		}
+		ownDrawsHandler(w, r)
+		return
+	}
+	if id == "demo" {
+		demoHandler(w, r)
+		return
+	}
+
+	dataMutex.RLock()
+	draw, ok := findDraw(id)
+	mergedInto := ""
+	if ok {
+		mergedInto = draw.MergedInto
+	}
+	dataMutex.RUnlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if mergedInto != "" {
+		// Participant tokens moved with the merge, so every old link still works
+		target := "/draw/" + mergedInto + strings.TrimPrefix(path, id)
+		if r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, target, http.StatusPermanentRedirect)
+		return
+	}
+
+	lang := drawLanguage(r, draw)
+	t := loadTranslations(lang)
+
+	// Extract action from path (e.g., "join", "manage", "participant/{token}", "draw")
+	action := ""
+	if slashIndex != -1 && slashIndex+1 < len(path) {
+		action = path[slashIndex+1:]
+	}
+
+	// Handle participants/{token}/photo
+	if strings.HasPrefix(action, "participants/") && strings.HasSuffix(action, "/photo") {
+		token := strings.TrimSuffix(strings.TrimPrefix(action, "participants/"), "/photo")
+		photoHandler(w, r, id, draw, token)
+		return
+	}
+
+	// Handle participants/{token}/opt-out
+	if strings.HasPrefix(action, "participants/") && strings.HasSuffix(action, "/opt-out") {
+		token := strings.TrimSuffix(strings.TrimPrefix(action, "participants/"), "/opt-out")
+		optOutHandler(w, r, id, draw, token)
+		return
+	}
+
+	// Handle participant/{token}/gift-bought
+	if strings.HasPrefix(action, "participant/") && strings.HasSuffix(action, "/gift-bought") {
+		token := strings.TrimSuffix(strings.TrimPrefix(action, "participant/"), "/gift-bought")
+		giftBoughtHandler(w, r, id, draw, token)
+		return
+	}
+
+	// Handle participant/{token}/submit
+	if strings.HasPrefix(action, "participant/") && strings.HasSuffix(action, "/submit") {
+		token := strings.TrimSuffix(strings.TrimPrefix(action, "participant/"), "/submit")
+		submitWishHandler(w, r, id, draw, token)
+		return
+	}
+
+	// Handle participant/{token} specially
+	if len(action) > 12 && action[:12] == "participant/" {
+		token := action[12:] // Extract token after "participant/"
+
+		dataMutex.RLock()
+		p, ok := draw.Participants[token]
+		dataMutex.RUnlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		photoAction := "/draw/" + id + "/participants/" + token + "/photo"
+		dataMutex.RLock()
+		pending := p.Pending
+		dataMutex.RUnlock()
+		// Participants who opted out or were never approved have no result to
+		// show, even after the draw
+		if !draw.DrawDone || p.OptedOut || pending {
+			canonical := fmt.Sprintf("https://%s%s", r.Host, r.URL.Path)
+			optOutAction := ""
+			if token != draw.OrganizerToken && !pending {
+				optOutAction = "/draw/" + id + "/participants/" + token + "/opt-out"
+			}
+			submitAction := ""
+			dataMutex.RLock()
+			if !draw.DrawDone && !pending && !p.OptedOut && !p.Submitted {
+				submitAction = "/draw/" + id + "/participant/" + token + "/submit"
+			}
+			dataMutex.RUnlock()
+			render(w, r, "participant.html", struct {
+				Name         string
+				Ready        bool
+				PhotoAction  string
+				Photo        string
+				RosterLink   string
+				OptedOut     bool
+				Pending      bool
+				OptOutAction string
+				SubmitAction string
+				Constraints  Constraints
+				T            Translations
+				CurrentLang  string
+				Canonical    string
+			}{p.Name, false, photoAction, p.Photo, "/draw/" + id + "/roster?token=" + token, p.OptedOut, pending, optOutAction, submitAction, draw.constraints(), t, lang, canonical})
+		} else {
+			dataMutex.Lock()
+			if p.ViewedAt.IsZero() {
+				p.ViewedAt = timeNow()
+				saveDataUnsafe()
+			}
+			dataMutex.Unlock()
+
+			// Find the wish of the person they're giving a gift to
+			recipientWish := ""
+			var recipientIdeas []string
+			type answer struct{ Label, Value string }
+			var recipientFields []answer
+			for _, participant := range draw.Participants {
+				if participant.Name == p.GiftFor {
+					recipientWish = participant.Wish
+					recipientIdeas = participant.GiftIdeas
+					for _, def := range draw.CustomFieldDefinitions {
+						if value := participant.CustomFields[def.Key]; value != "" {
+							recipientFields = append(recipientFields, answer{def.Label, value})
+						}
+					}
+					break
+				}
+			}
+			// In surprise mode the first page only links to ?reveal=1, the recipient
+			// isn't even sent to the browser until then
+			surprise := draw.SurpriseReveal && r.URL.Query().Get("reveal") != "1"
+			revealed := draw.SurpriseReveal && !surprise
+			giftFor := p.GiftFor
+			if surprise {
+				giftFor, recipientWish, recipientIdeas, recipientFields = "", "", nil, nil
+			}
+			canonical := fmt.Sprintf("https://%s%s", r.Host, r.URL.Path)
+			render(w, r, "participant.html", struct {
+				Name             string
+				Ready            bool
+				Surprise         bool
+				Revealed         bool
+				GiftFor          string
+				Wish             string
+				GiftIdeas        []string
+				Fields           []answer
+				PhotoAction      string
+				Photo            string
+				GiftBought       string
+				GiftBoughtAction string
+				Constraints      Constraints
+				T                Translations
+				CurrentLang      string
+				Canonical        string
+			}{p.Name, true, surprise, revealed, giftFor, recipientWish, recipientIdeas, recipientFields, photoAction, p.Photo, p.GiftBought,
+				"/draw/" + id + "/participant/" + token + "/gift-bought", formConstraints, t, lang, canonical})
+		}
+		return
+	}
+
+	if jsonRoutes[action] && handleCORS(w, r) {
+		return
+	}
+
+	switch action {
+	case "join":
+		dataMutex.RLock()
+		expired := draw.joinExpired()
+		dataMutex.RUnlock()
+		if r.Method == http.MethodGet {
+			canonical := fmt.Sprintf("https://%s%s", r.Host, r.URL.Path)
+			render(w, r, "join.html", struct {
+				EventID     string
+				Expired     bool
+				Fields      []FieldDef
+				T           Translations
+				CurrentLang string
+				Canonical   string
+				Constraints Constraints
+			}{id, expired, draw.CustomFieldDefinitions, t, lang, canonical, draw.constraints()})
+			return
+		}
+		if drawsFrozen() {
+			writeError(w, r, http.StatusServiceUnavailable, "read_only")
+			return
+		}
+		if expired {
+			writeError(w, r, http.StatusGone, "join_expired")
+			return
+		}
+		ipHash := hashIP(clientIP(r))
+		dataMutex.RLock()
+		banned := slices.Contains(draw.BannedIPs, ipHash)
+		dataMutex.RUnlock()
+		if banned {
+			writeError(w, r, http.StatusForbidden, "banned")
+			return
+		}
+		r.ParseForm()
+
+		// Check if draw has reached participant limit
+		isFull := draw.ExpectedParticipants != nil && draw.participantTotal() >= *draw.ExpectedParticipants
+
+		if isFull {
+			writeError(w, r, http.StatusForbidden, "event_full")
+			return
+		}
+
+		name := r.FormValue("name")
+		wish := normalizeWish(r.FormValue("wish"))
+
+		// Validate inputs
+		name, err := validateInput(name, maxNameLength, "Name")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if code := checkNameRules(name); code != "" {
+			writeNameError(w, r, code)
+			return
+		}
+
+		// Wish is optional but has max length if provided
+		if wish != "" {
+			if limit := draw.wishLimit(); utf8.RuneCountInString(wish) > limit {
+				http.Error(w, fmt.Sprintf("Wish is too long (max %d characters)", limit), http.StatusBadRequest)
+				return
+			}
+		}
+
+		giftIdeas, err := parseGiftIdeas(r.FormValue("ideas"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		avoid, err := parseAvoidNames(r.FormValue("avoid"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		customFields, err := parseCustomFields(r, draw.CustomFieldDefinitions)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		token := generateSecureToken()
+
+		dataMutex.Lock()
+		// Check again under the write lock: concurrent joins may have passed the
+		// lock-free check above and filled the last spots in the meantime
+		if draw.ExpectedParticipants != nil && len(draw.activeParticipants()) >= *draw.ExpectedParticipants {
+			dataMutex.Unlock()
+			writeError(w, r, http.StatusForbidden, "event_full")
+			return
+		}
+		// Pending joins don't take a spot, but they can't pile up either
+		waiting := 0
+		for _, p := range draw.Participants {
+			if p.Pending {
+				waiting++
+			}
+		}
+		if len(draw.activeParticipants())+waiting >= maxParticipants || len(draw.Participants) >= maxParticipantRows {
+			dataMutex.Unlock()
+			writeError(w, r, http.StatusForbidden, "event_full")
+			return
+		}
+		if draw.OriginalNames != nil {
+			// Names are hidden, late joiners get the next codename
+			draw.OriginalNames[token] = name
+			name = codename(draw.CodenamesIssued)
+			draw.CodenamesIssued++
+		}
+		// Joins awaiting approval don't take a spot until the organizer accepts them
+		pending := draw.ApprovalRequired
+		draw.Participants[token] = &Participant{Name: name, Wish: wish, GiftIdeas: giftIdeas, Submitted: !pending, Pending: pending, JoinedAt: timeNow(), Language: lang, IPHash: ipHash, Avoid: avoid, CustomFields: customFields}
+		if !pending {
+			draw.participantCount.Add(1)
+		}
+		notifySubscribers(id, draw)
+		dataMutex.Unlock()
+
+		saveData()
+		http.Redirect(w, r, "/draw/"+id+"/participant/"+token, http.StatusSeeOther)
+
+	case "join-count":
+		// Public counter for embedding in join link messages, no authentication needed
+		dataMutex.RLock()
+		u := newDrawUpdate(draw)
+		dataMutex.RUnlock()
+
+		etag := fmt.Sprintf(`"%d-%t"`, u.Participants, u.DrawDone)
+		w.Header().Set("Cache-Control", "public, max-age=30")
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		writeJSON(w, http.StatusOK, struct {
+			Current  int  `json:"current"`
+			Expected int  `json:"expected"`
+			DrawDone bool `json:"drawDone"`
+		}{u.Participants, u.Expected, u.DrawDone})
+
+	case "status":
+		// Public per-participant progress for frontends. Participants are
+		// identified by publicID, never by token, and names only when the
+		// organizer allowed it.
+		type participantStatus struct {
+			PublicID  string `json:"publicId"`
+			Name      string `json:"name,omitempty"`
+			Submitted bool   `json:"submitted"`
+		}
+		dataMutex.RLock()
+		u := newDrawUpdate(draw)
+		people := make([]participantStatus, 0, len(draw.Participants))
+		for token, p := range draw.activeParticipants() {
+			ps := participantStatus{PublicID: publicID(token), Submitted: p.Submitted}
+			if draw.PublicNames {
+				ps.Name = p.Name
+			}
+			people = append(people, ps)
+		}
+		dataMutex.RUnlock()
+		sort.Slice(people, func(i, j int) bool { return people[i].PublicID < people[j].PublicID })
+		writeJSON(w, http.StatusOK, struct {
+			drawUpdate
+			People []participantStatus `json:"people"`
+		}{u, people})
+
+	case "ttl":
+		// Tells organizers when their draw will be deleted automatically
+		dataMutex.RLock()
+		days, expiry := retentionFor(draw), deleteAt(draw)
+		dataMutex.RUnlock()
+		remaining := int64(expiry.Sub(timeNow()).Seconds())
+		if remaining < 0 {
+			remaining = 0
+		}
+		writeJSON(w, http.StatusOK, struct {
+			CreatedAt        time.Time `json:"createdAt"`
+			RetentionDays    int       `json:"retentionDays"`
+			DeleteAt         time.Time `json:"deleteAt"`
+			SecondsRemaining int64     `json:"secondsRemaining"`
+		}{draw.CreatedAt, days, expiry, remaining})
+
+	case "manifest.json":
+		// Web app manifest so organizers can install the manage page on their phone.
+		// The organizer token is only kept in start_url when it is valid.
+		type icon struct {
+			Src   string `json:"src"`
+			Sizes string `json:"sizes"`
+			Type  string `json:"type"`
+		}
+		startURL := "/draw/" + id + "/manage"
+		if organizer := r.URL.Query().Get("organizer"); draw.isOrganizer(organizer) {
+			startURL += "?organizer=" + organizer
+		}
+		w.Header().Set("Content-Type", "application/manifest+json")
+		json.NewEncoder(w).Encode(struct {
+			Name            string `json:"name"`
+			ShortName       string `json:"short_name"`
+			StartURL        string `json:"start_url"`
+			Display         string `json:"display"`
+			BackgroundColor string `json:"background_color"`
+			ThemeColor      string `json:"theme_color"`
+			Icons           []icon `json:"icons"`
+		}{"Secret Santa – " + draw.Name, "Santa", startURL, "standalone", "#c41e3a", "#c41e3a", []icon{
+			{"/static/icon-192.png", "192x192", "image/png"},
+			{"/static/icon-512.png", "512x512", "image/png"},
+		}})
+
+	case "events":
+		// Server-sent events stream of participant counts for the manage page
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+		ip := clientIP(r)
+		updates := make(chan drawUpdate, 1)
+		dataMutex.Lock()
+		if len(drawSubscribers[id]) >= maxStreamsPerDraw || streamsPerIP[ip] >= maxStreamsPerIP {
+			dataMutex.Unlock()
+			// The page falls back to reloading every few seconds
+			w.Header().Set("Retry-After", "30")
+			http.Error(w, "Too many live updates open", http.StatusServiceUnavailable)
+			return
+		}
+		streamsPerIP[ip]++
+		if drawSubscribers[id] == nil {
+			drawSubscribers[id] = make(map[chan drawUpdate]struct{})
+		}
+		drawSubscribers[id][updates] = struct{}{}
+		updates <- newDrawUpdate(draw)
+		dataMutex.Unlock()
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+
+		defer func() {
+			dataMutex.Lock()
+			delete(drawSubscribers[id], updates)
+			if len(drawSubscribers[id]) == 0 {
+				delete(drawSubscribers, id)
+			}
+			if streamsPerIP[ip]--; streamsPerIP[ip] == 0 {
+				delete(streamsPerIP, ip)
+			}
+			dataMutex.Unlock()
+		}()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case u := <-updates:
+				// Stamped when sent so clients can spot clock skew and stale events
+				payload, _ := json.Marshal(struct {
+					drawUpdate
+					SentAt time.Time `json:"time"`
+				}{u, timeNow().UTC()})
+				fmt.Fprintf(w, "data: %s\n\n", payload)
+				flusher.Flush()
+			}
+		}
+
+	case "name-check":
+		// Lets the join form warn about duplicate or near-duplicate names before
+		// submitting. Only booleans: anyone with the link may ask, names stay private.
+		name := strings.TrimSpace(r.URL.Query().Get("name"))
+		dataMutex.RLock()
+		available := true
+		for _, p := range draw.Participants {
+			if strings.EqualFold(p.Name, name) {
+				available = false
+				break
+			}
+		}
+		similar := draw.NameSimilarityCheck && name != "" && len(similarNames(draw, name)) > 0
+		dataMutex.RUnlock()
+
+		writeJSON(w, http.StatusOK, struct {
+			Available bool `json:"available"`
+			Similar   bool `json:"similar"`
+		}{available, similar})
+
+	case "participants.csv":
+		participantsCSVHandler(w, r, id, draw)
+
+	case "roster":
+		// Names only, for participants checking they joined the right group
+		token := r.URL.Query().Get("token")
+		dataMutex.RLock()
+		// Joins awaiting approval aren't part of the group yet
+		p, ok := draw.Participants[token]
+		ok = ok && !p.Pending
+		names := make([]string, 0, len(draw.Participants))
+		for _, p := range draw.activeParticipants() {
+			names = append(names, p.Name)
+		}
+		dataMutex.RUnlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		sort.Strings(names)
+		render(w, r, "roster.html", struct {
+			EventName   string
+			Names       []string
+			BackLink    string
+			T           Translations
+			CurrentLang string
+			Canonical   string
+		}{draw.Name, names, "/draw/" + id + "/participant/" + token, t, lang, ""})
+
+	case "ban-ip", "bans":
+		banHandler(w, r, id, draw, action)
+
+	case "pins":
+		pinsHandler(w, r, id, draw)
+
+	case "participants/shuffle-names", "reveal-names":
+		namesHandler(w, r, id, draw, action)
+
+	case "extend-join":
+		if r.Method != http.MethodPost || joinURLTTL <= 0 || !draw.isOrganizer(r.URL.Query().Get("organizer")) {
+			http.NotFound(w, r)
+			return
+		}
+		dataMutex.Lock()
+		// Extending an expired link counts from now, not from the old expiry
+		expiresAt := timeNow()
+		if draw.JoinExpiresAt != nil && draw.JoinExpiresAt.After(expiresAt) {
+			expiresAt = *draw.JoinExpiresAt
+		}
+		expiresAt = expiresAt.Add(joinURLTTL)
+		draw.JoinExpiresAt = &expiresAt
+		addAudit(draw, "extend-join", expiresAt.Format(time.RFC3339))
+		saveDataUnsafe()
+		dataMutex.Unlock()
+		if !wantsJSON(r) {
+			http.Redirect(w, r, "/draw/"+id+"/manage?organizer="+draw.OrganizerToken, http.StatusSeeOther)
+			return
+		}
+		writeJSON(w, http.StatusOK, struct {
+			JoinExpiresAt time.Time `json:"joinExpiresAt"`
+		}{expiresAt})
+
+	case "merge":
+		mergeHandler(w, r, id, draw)
+
+	case "star":
+		starParticipantHandler(w, r, id, draw)
+
+	case "approve", "reject":
+		approvalHandler(w, r, id, draw, action)
+
+	case "tags":
+		if r.Method != http.MethodPost || !draw.isOrganizer(r.URL.Query().Get("organizer")) {
+			http.NotFound(w, r)
+			return
+		}
+		tags, err := normalizeTags(r.FormValue("tags"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		dataMutex.Lock()
+		setTags(id, draw, tags)
+		saveDataUnsafe()
+		dataMutex.Unlock()
+		writeJSON(w, http.StatusOK, struct {
+			Tags []string `json:"tags"`
+		}{append([]string{}, tags...)})
+
+	case "manage":
+		dataMutex.RLock()
+		activeCount := len(draw.activeParticipants())
+		order := starredFirst(draw)
+		var duplicates map[string]bool
+		if draw.FlagDuplicateWishes && draw.isOrganizer(r.URL.Query().Get("organizer")) {
+			duplicates = duplicateWishes(draw)
+		}
+		allSubmitted := true
+		for _, part := range draw.Participants {
+			if !part.Submitted {
+				allSubmitted = false
+				break
+			}
+		}
+
+		// Check if expected number of participants is reached
+		expectedReached := false
+		if draw.ExpectedParticipants != nil {
+			expectedReached = activeCount >= *draw.ExpectedParticipants
+		}
+		dataMutex.RUnlock()
+
+		joinLink := baseURL(r) + "/draw/" + id + "/join"
+		shortLink := ""
+		if draw.ShortID != "" {
+			shortLink = baseURL(r) + "/s/" + draw.ShortID
+		}
+		organizerToken := r.URL.Query().Get("organizer")
+		organizerLink := ""
+		organizerGiftFor := ""
+		organizerRecipientWish := ""
+		var organizerRecipientIdeas []string
+		organizerName := ""
+		if organizerToken != "" && draw.DrawDone {
+			organizerLink = baseURL(r) + "/draw/" + id + "/participant/" + organizerToken
+			if org, ok := draw.Participants[organizerToken]; ok {
+				organizerName = org.Name
+				organizerGiftFor = org.GiftFor
+				for _, p := range draw.Participants {
+					if p.Name == org.GiftFor {
+						organizerRecipientWish = p.Wish
+						organizerRecipientIdeas = p.GiftIdeas
+						break
+					}
+				}
+			}
+		}
+		canDraw := allSubmitted && !draw.DrawDone && expectedReached
+		organizerSubmitted := true
+		dataMutex.RLock()
+		if org, ok := draw.Participants[organizerToken]; ok && draw.isOrganizer(organizerToken) {
+			organizerSubmitted = org.Submitted
+		}
+		dataMutex.RUnlock()
+		canonical := fmt.Sprintf("https://%s%s", r.Host, r.URL.Path)
+		expectedCount := 0
+		if draw.ExpectedParticipants != nil {
+			expectedCount = *draw.ExpectedParticipants
+		}
+		render(w, r, "manage.html", struct {
+			EventID                 string
+			EventName               string
+			JoinLink                string
+			ShortLink               string
+			JoinCode                string
+			OrganizerLink           string
+			OrganizerToken          string
+			OrganizerName           string
+			OrganizerSubmitted      bool
+			OrganizerGiftFor        string
+			OrganizerRecipientWish  string
+			OrganizerRecipientIdeas []string
+			Participants            map[string]*Participant
+			Order                   []string
+			ActiveCount             int
+			ExpectedCount           int
+			CanDraw                 bool
+			DrawDone                bool
+			Demo                    bool
+			IsOrganizer             bool
+			Pins                    map[string]string
+			RequireWishes           bool
+			Tags                    []string
+			JoinExpiresAt           *time.Time
+			CanExtendJoin           bool
+			DrawnAt                 *time.Time
+			NamesHidden             bool
+			DuplicateWishes         map[string]bool
+			T                       Translations
+			CurrentLang             string
+			Canonical               string
+		}{id, draw.Name, joinLink, shortLink, draw.JoinCode, organizerLink, organizerToken, organizerName, organizerSubmitted, organizerGiftFor, organizerRecipientWish, organizerRecipientIdeas, draw.Participants, order, activeCount, expectedCount, canDraw, draw.DrawDone, draw.demo, draw.isOrganizer(organizerToken), draw.Pins, draw.RequireWishes, draw.Tags, draw.JoinExpiresAt, joinURLTTL > 0 && draw.isOrganizer(organizerToken), draw.DrawnAt, draw.OriginalNames != nil, duplicates, t, lang, canonical})
+
+	case "draw":
+		if r.Method != http.MethodPost {
+			http.NotFound(w, r)
+			return
+		}
+		if drawsFrozen() {
+			writeError(w, r, http.StatusServiceUnavailable, "read_only")
+			return
+		}
+		if !acquireDrawSlot(w) {
+			return
+		}
+		defer releaseDrawSlot()
+
+		dataMutex.RLock()
+		// Avoid premature draws right after creation
+		if !draw.demo && timeNow().Sub(draw.CreatedAt) < minWaitBeforeDraw {
+			dataMutex.RUnlock()
+			writeError(w, r, http.StatusConflict, "draw_too_soon")
+			return
+		}
+
+		// Need at least 3 participants for a proper Secret Santa
+		if len(draw.activeParticipants()) < 3 {
+			dataMutex.RUnlock()
+			http.Error(w, "Need at least 3 participants", http.StatusBadRequest)
+			return
+		}
+
+		if draw.RequireWishes {
+			var missing []string
+			for _, p := range draw.activeParticipants() {
+				if p.Wish == "" {
+					missing = append(missing, p.Name)
+				}
+			}
+			if len(missing) > 0 {
+				dataMutex.RUnlock()
+				sort.Strings(missing)
+				writeError(w, r, http.StatusBadRequest, "missing_wishes", "{names}", strings.Join(missing, ", "))
+				return
+			}
+		}
+		snapshot := draw.shuffleSnapshot()
+		dataMutex.RUnlock()
+
+		// Record the seed before shuffling so the attempt can be replayed later
+		seed, seedHex := generateSeed()
+		record := ShuffleRecord{AttemptedAt: timeNow(), SeedHex: seedHex}
+
+		// Shuffle without dataMutex so a slow search doesn't hold up every other draw
+		assignment, err := assignGifts(snapshot, seed)
+
+		dataMutex.Lock()
+		defer dataMutex.Unlock()
+		if !reflect.DeepEqual(draw.shuffleSnapshot(), snapshot) {
+			http.Error(w, "The participants changed during the draw, please draw again", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			draw.ShuffleHistory = append(draw.ShuffleHistory, record)
+			saveDataUnsafe()
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		for t, receiver := range assignment {
+			draw.Participants[t].GiftFor = receiver
+		}
+		record.Succeeded = true
+		record.AssignmentHash = assignmentHash(draw.Participants, assignment)
+		draw.ShuffleHistory = append(draw.ShuffleHistory, record)
+		draw.DrawDone = true
+		drawnAt := timeNow()
+		draw.DrawnAt = &drawnAt
+		notifySubscribers(id, draw)
+		saveDataUnsafe()
+
+		// Redirect back to manage page, preserving organizer token if present
+		organizerToken := r.URL.Query().Get("organizer")
+		redirectURL := "/draw/" + id + "/manage"
+		if organizerToken != "" {
+			redirectURL += "?organizer=" + organizerToken
+		}
+		http.Redirect(w, r, redirectURL, http.StatusSeeOther)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// drawUpdate is the redacted state pushed to live-update subscribers
+type drawUpdate struct {
+	Participants int  `json:"participants"`
+	Expected     int  `json:"expected"`
+	Submitted    int  `json:"submitted"`
+	DrawDone     bool `json:"drawDone"`
+}
+
+// newDrawUpdate summarizes a draw without names, wishes or assignments.
+// Note: This function should be called when dataMutex is already locked
+func newDrawUpdate(draw *Draw) drawUpdate {
+	active := draw.activeParticipants()
+	u := drawUpdate{Participants: len(active), DrawDone: draw.DrawDone}
+	if draw.ExpectedParticipants != nil {
+		u.Expected = *draw.ExpectedParticipants
+	}
+	for _, p := range active {
+		if p.Submitted {
+			u.Submitted++
+		}
+	}
+	return u
+}
+
+// notifySubscribers pushes the current state of a draw to everyone watching it.
+// Note: This function should be called when dataMutex is already locked (write lock)
+func notifySubscribers(id string, draw *Draw) {
+	u := newDrawUpdate(draw)
+	for ch := range drawSubscribers[id] {
+		// Replace any update the client hasn't read yet, only the latest state matters
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- u
+	}
+}
+
+// addAudit appends an entry to the draw's audit log.
+// Note: This function should be called when dataMutex is already locked
+func addAudit(draw *Draw, action, detail string) {
+	draw.AuditLog = append(draw.AuditLog, AuditEntry{At: timeNow(), Action: action, Detail: detail})
+}
+
+// demoDraws holds the /draw/demo sandboxes. They live in memory only, so they
+// are never saved, don't count towards maxActiveEvents and disappear after
+// demoTTL. Guarded by dataMutex.
+var demoDraws = make(map[string]*Draw)
+
+const (
+	demoTTL      = 10 * time.Minute
+	maxDemoDraws = 100
+)
+
+// findDraw returns the stored draw with this id, or a demo draw that hasn't
+// expired yet.
+// Note: This function should be called when dataMutex is already locked
+func findDraw(id string) (*Draw, bool) {
+	if draw, ok := appData.Events[id]; ok {
+		return draw, true
+	}
+	draw, ok := demoDraws[id]
+	if !ok || timeNow().Sub(draw.CreatedAt) > demoTTL {
+		return nil, false
+	}
+	return draw, true
+}
+
+// demoHandler creates a throwaway draw so new organizers can try the whole
+// flow, then sends them to its manage page.
+func demoHandler(w http.ResponseWriter, r *http.Request) {
+	t := loadTranslations(getLanguage(r))
+	id := generateSecureToken()
+	organizerToken := generateSecureToken()
+	expected := minParticipants
+
+	dataMutex.Lock()
+	for demoID, draw := range demoDraws {
+		if timeNow().Sub(draw.CreatedAt) > demoTTL {
+			delete(demoDraws, demoID)
+		}
+	}
+	if len(demoDraws) >= maxDemoDraws {
+		dataMutex.Unlock()
+		http.Error(w, "Too many demo draws right now. Please try again in a few minutes.", http.StatusServiceUnavailable)
+		return
+	}
+	draw := &Draw{
+		Name:                 t.Get("demo_draw_name"),
+		ExpectedParticipants: &expected,
+		Participants: map[string]*Participant{
+			organizerToken: {
+				Name:      t.Get("demo_organizer_name"),
+				Submitted: true,
+				JoinedAt:  timeNow(),
+				Language:  getLanguage(r),
+			},
+		},
+		CreatedAt:           timeNow(),
+		NameSimilarityCheck: true,
+		OrganizerToken:      organizerToken,
+		demo:                true,
+	}
+	draw.participantCount.Store(1)
+	demoDraws[id] = draw
+	dataMutex.Unlock()
+
+	http.Redirect(w, r, "/draw/"+id+"/manage?organizer="+organizerToken, http.StatusSeeOther)
+}
+
+// ownDrawsHandler lists the recent draws created from the visitor's IP address.
+// This is an approximate recovery aid for organizers who lost their manage link:
+// shared or changing addresses make it miss draws or show someone else's.
+func ownDrawsHandler(w http.ResponseWriter, r *http.Request) {
+	type ownDraw struct {
+		Name      string    `json:"name"`
+		CreatedAt time.Time `json:"createdAt"`
+		ManageURL string    `json:"manageUrl"`
+	}
+
+	ipHash := hashIP(clientIP(r))
+	cutoff := timeNow().Add(-ownDrawsMaxAge)
+	tag := strings.ToLower(r.URL.Query().Get("tag"))
+	draws := []ownDraw{}
+	dataMutex.RLock()
+	for id, draw := range appData.Events {
+		if tag != "" && !tagIndex[tag][id] {
+			continue
+		}
+		if draw.CreatedByIP == ipHash && draw.CreatedAt.After(cutoff) {
+			draws = append(draws, ownDraw{draw.Name, draw.CreatedAt, baseURL(r) + "/draw/" + id + "/manage"})
+		}
+	}
+	dataMutex.RUnlock()
+	sort.Slice(draws, func(i, j int) bool { return draws[i].CreatedAt.After(draws[j].CreatedAt) })
+
+	writeJSON(w, http.StatusOK, struct {
+		Approximate bool      `json:"approximate"`
+		Draws       []ownDraw `json:"draws"`
+	}{true, draws})
+}
+
+// participantsCSVHandler exports the participant list for spreadsheets. Only
+// the organizer may download it, and giftFor is included once the draw is done.
+// ?sort= orders the rows by "joined" (the default), "giver" or "receiver".
+func participantsCSVHandler(w http.ResponseWriter, r *http.Request, id string, draw *Draw) {
+	if !draw.isOrganizer(r.URL.Query().Get("organizer")) {
+		http.NotFound(w, r)
+		return
+	}
+	sortBy := r.URL.Query().Get("sort")
+	if sortBy == "" {
+		sortBy = "joined"
+	}
+	if sortBy != "joined" && sortBy != "giver" && sortBy != "receiver" {
+		http.Error(w, `sort must be "joined", "giver" or "receiver"`, http.StatusBadRequest)
+		return
+	}
+
+	formatTime := func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.UTC().Format(time.RFC3339)
+	}
+
+	dataMutex.RLock()
+	withGiftFor := draw.DrawDone
+	participants := make([]Participant, 0, len(draw.Participants))
+	for _, p := range draw.Participants {
+		participants = append(participants, *p)
+	}
+	dataMutex.RUnlock()
+
+	// Starred participants come first, the giver name breaks ties, e.g. for
+	// draws from before JoinedAt
+	sort.Slice(participants, func(i, j int) bool {
+		a, b := participants[i], participants[j]
+		switch {
+		case a.Starred != b.Starred:
+			return a.Starred
+		case sortBy == "joined" && !a.JoinedAt.Equal(b.JoinedAt):
+			return a.JoinedAt.Before(b.JoinedAt)
+		case sortBy == "receiver" && a.GiftFor != b.GiftFor:
+			return a.GiftFor < b.GiftFor
+		}
+		return a.Name < b.Name
+	})
+
+	header := []string{"name", "wish"}
+	if withGiftFor {
+		header = append(header, "giftFor")
+	}
+	header = append(header, "joinedAt", "confirmed", "viewedAt")
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="participants-`+id+`.csv"`)
+	cw := csv.NewWriter(w)
+	cw.Write(header)
+	for _, p := range participants {
+		row := []string{csvCell(p.Name), csvCell(p.Wish)}
+		if withGiftFor {
+			row = append(row, csvCell(p.GiftFor))
+		}
+		row = append(row, formatTime(p.JoinedAt), strconv.FormatBool(p.Submitted), formatTime(p.ViewedAt))
+		cw.Write(row)
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		log.Printf("Error writing participants CSV for draw %s: %v", id, err)
+	}
+}
+
+// csvCell keeps text typed by participants from being run as a formula when
+// the CSV is opened in a spreadsheet, by prefixing the characters that start one
+func csvCell(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+// banHandler lets the organizer stop a participant's IP address from joining
+// again. POST ban-ip with participant={token} adds a ban; GET bans lists them
+// and POST bans with unban={hash} lifts one. Existing participants stay.
+func banHandler(w http.ResponseWriter, r *http.Request, id string, draw *Draw, action string) {
+	if !draw.isOrganizer(r.URL.Query().Get("organizer")) {
+		http.NotFound(w, r)
+		return
+	}
+
+	type ban struct {
+		ID           string   `json:"id"`
+		Participants []string `json:"participants"` // who joined from that address
+	}
+
+	switch {
+	case action == "ban-ip" && r.Method == http.MethodPost:
+		token := r.FormValue("participant")
+		dataMutex.Lock()
+		p, ok := draw.Participants[token]
+		if !ok || token == draw.OrganizerToken {
+			dataMutex.Unlock()
+			http.Error(w, "Unknown participant", http.StatusBadRequest)
+			return
+		}
+		if p.IPHash == "" {
+			dataMutex.Unlock()
+			http.Error(w, "No address is known for this participant", http.StatusConflict)
+			return
+		}
+		if !slices.Contains(draw.BannedIPs, p.IPHash) {
+			draw.BannedIPs = append(draw.BannedIPs, p.IPHash)
+			addAudit(draw, "ban-ip", p.Name)
+			saveDataUnsafe()
+		}
+		dataMutex.Unlock()
+		if !wantsJSON(r) {
+			// Sent from the manage page form
+			http.Redirect(w, r, "/draw/"+id+"/manage?organizer="+draw.OrganizerToken, http.StatusSeeOther)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case action == "bans" && r.Method == http.MethodGet:
+		dataMutex.RLock()
+		bans := make([]ban, 0, len(draw.BannedIPs))
+		for _, hash := range draw.BannedIPs {
+			b := ban{ID: hash, Participants: []string{}}
+			for _, p := range draw.Participants {
+				if p.IPHash == hash {
+					b.Participants = append(b.Participants, p.Name)
+				}
+			}
+			sort.Strings(b.Participants)
+			bans = append(bans, b)
+		}
+		dataMutex.RUnlock()
+		writeJSON(w, http.StatusOK, bans)
+
+	case action == "bans" && r.Method == http.MethodPost:
+		hash := r.FormValue("unban")
+		dataMutex.Lock()
+		i := slices.Index(draw.BannedIPs, hash)
+		if i == -1 {
+			dataMutex.Unlock()
+			http.NotFound(w, r)
+			return
+		}
+		draw.BannedIPs = slices.Delete(draw.BannedIPs, i, i+1)
+		addAudit(draw, "unban-ip", hash)
+		saveDataUnsafe()
+		dataMutex.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// codenames are the display names given by shuffle-names. The number keeps
+// them unique, e.g. "Elf #1", "Snowflake #2".
+var codenames = []string{"Elf", "Snowflake", "Reindeer", "Star", "Candle", "Mitten", "Bell", "Pinecone"}
+
+// codename returns the n-th codename, counting from 0
+func codename(n int) string {
+	return fmt.Sprintf("%s #%d", codenames[n%len(codenames)], n+1)
+}
+
+// namesHandler lets the organizer hide everyone's name behind a codename
+// until after the draw. POST participants/shuffle-names hides them before the
+// draw, POST reveal-names puts them back once it is done.
+func namesHandler(w http.ResponseWriter, r *http.Request, id string, draw *Draw, action string) {
+	if r.Method != http.MethodPost || !draw.isOrganizer(r.URL.Query().Get("organizer")) {
+		http.NotFound(w, r)
+		return
+	}
+
+	dataMutex.Lock()
+	switch action {
+	case "participants/shuffle-names":
+		if draw.DrawDone || draw.OriginalNames != nil {
+			dataMutex.Unlock()
+			http.Error(w, "Names can only be hidden once, before the draw", http.StatusConflict)
+			return
+		}
+		// Hand out codenames in random order so they don't follow the join order
+		tokens := make([]string, 0, len(draw.Participants))
+		for t := range draw.Participants {
+			tokens = append(tokens, t)
+		}
+		sort.Strings(tokens)
+		seed, _ := generateSeed()
+		mathrand.New(mathrand.NewSource(seed)).Shuffle(len(tokens), func(i, j int) { tokens[i], tokens[j] = tokens[j], tokens[i] })
+
+		draw.OriginalNames = make(map[string]string, len(tokens))
+		for i, t := range tokens {
+			draw.OriginalNames[t] = draw.Participants[t].Name
+			draw.Participants[t].Name = codename(i)
+		}
+		draw.CodenamesIssued = len(tokens)
+		addAudit(draw, "shuffle-names", "")
+
+	case "reveal-names":
+		if !draw.DrawDone || draw.OriginalNames == nil {
+			dataMutex.Unlock()
+			http.Error(w, "Names can only be revealed after the draw", http.StatusConflict)
+			return
+		}
+		// GiftFor holds codenames, translate them before the names change
+		realNames := make(map[string]string, len(draw.OriginalNames))
+		for t, name := range draw.OriginalNames {
+			if p, ok := draw.Participants[t]; ok {
+				realNames[p.Name] = name
+			}
+		}
+		for _, p := range draw.Participants {
+			if name, ok := realNames[p.GiftFor]; ok {
+				p.GiftFor = name
+			}
+		}
+		for t, name := range draw.OriginalNames {
+			if p, ok := draw.Participants[t]; ok {
+				p.Name = name
+			}
+		}
+		draw.OriginalNames = nil
+		addAudit(draw, "reveal-names", "")
+	}
+	notifySubscribers(id, draw)
+	saveDataUnsafe()
+	dataMutex.Unlock()
+
+	if !wantsJSON(r) {
+		http.Redirect(w, r, "/draw/"+id+"/manage?organizer="+draw.OrganizerToken, http.StatusSeeOther)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// approvalHandler settles a join waiting for approval, participant={token}.
+// approve makes it a regular participant as long as the draw has room left,
+// reject removes it.
+func approvalHandler(w http.ResponseWriter, r *http.Request, id string, draw *Draw, action string) {
+	if r.Method != http.MethodPost || !draw.isOrganizer(r.URL.Query().Get("organizer")) {
+		http.NotFound(w, r)
+		return
+	}
+
+	token := r.FormValue("participant")
+	dataMutex.Lock()
+	p, ok := draw.Participants[token]
+	if !ok || !p.Pending {
+		dataMutex.Unlock()
+		http.Error(w, "No such join awaiting approval", http.StatusBadRequest)
+		return
+	}
+	if draw.DrawDone {
+		dataMutex.Unlock()
+		http.Error(w, "The draw is already done", http.StatusConflict)
+		return
+	}
+	name := draw.realName(token)
+	if action == "approve" {
+		if draw.ExpectedParticipants != nil && len(draw.activeParticipants()) >= *draw.ExpectedParticipants {
+			dataMutex.Unlock()
+			writeError(w, r, http.StatusConflict, "event_full")
+			return
+		}
+		p.Pending = false
+		p.Submitted = true
+		draw.participantCount.Add(1)
+	} else {
+		delete(draw.Participants, token)
+		delete(draw.OriginalNames, token)
+	}
+	addAudit(draw, action, name)
+	notifySubscribers(id, draw)
+	saveDataUnsafe()
+	dataMutex.Unlock()
+
+	if !wantsJSON(r) {
+		http.Redirect(w, r, "/draw/"+id+"/manage?organizer="+draw.OrganizerToken, http.StatusSeeOther)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// starParticipantHandler toggles whether participant={token} is starred, which
+// lists them first for the organizer. It's only about display, drawing ignores it.
+func starParticipantHandler(w http.ResponseWriter, r *http.Request, id string, draw *Draw) {
+	if r.Method != http.MethodPost || !draw.isOrganizer(r.URL.Query().Get("organizer")) {
+		http.NotFound(w, r)
+		return
+	}
+
+	dataMutex.Lock()
+	p, ok := draw.Participants[r.FormValue("participant")]
+	if !ok {
+		dataMutex.Unlock()
+		http.Error(w, "Unknown participant", http.StatusBadRequest)
+		return
+	}
+	p.Starred = !p.Starred
+	starred := p.Starred
+	saveDataUnsafe()
+	dataMutex.Unlock()
+
+	if !wantsJSON(r) {
+		http.Redirect(w, r, "/draw/"+id+"/manage?organizer="+draw.OrganizerToken, http.StatusSeeOther)
+		return
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Starred bool `json:"starred"`
+	}{starred})
+}
+
+// starredFirst returns the participant tokens of the draw, starred participants
+// first, then by name
+// Note: This function should be called when dataMutex is already locked
+func starredFirst(draw *Draw) []string {
+	tokens := make([]string, 0, len(draw.Participants))
+	for token := range draw.Participants {
+		tokens = append(tokens, token)
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		a, b := draw.Participants[tokens[i]], draw.Participants[tokens[j]]
+		if a.Starred != b.Starred {
+			return a.Starred
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return tokens[i] < tokens[j]
+	})
+	return tokens
+}
+
+// mergeHandler moves every participant of another draw into this one, for when
+// two people organized the same group. Both organizer tokens are required: this
+// draw's as ?organizer=, the other's as the sourceorganizer form value with its
+// ID as source. The browser form sends the other manage link as sourcelink instead.
+// Participants keep their tokens and the other draw redirects here.
+func mergeHandler(w http.ResponseWriter, r *http.Request, id string, draw *Draw) {
+	if r.Method != http.MethodPost || !draw.isOrganizer(r.URL.Query().Get("organizer")) {
+		http.NotFound(w, r)
+		return
+	}
+
+	sourceID, sourceOrganizer := r.FormValue("source"), r.FormValue("sourceorganizer")
+	if link := r.FormValue("sourcelink"); link != "" && sourceID == "" {
+		if u, err := url.Parse(strings.TrimSpace(link)); err == nil {
+			parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+			if len(parts) >= 2 && parts[0] == "draw" {
+				sourceID = parts[1]
+			}
+			sourceOrganizer = u.Query().Get("organizer")
+		}
+	}
+
+	dataMutex.Lock()
+	source, ok := appData.Events[sourceID]
+	if !ok || sourceID == id || !source.isOrganizer(sourceOrganizer) || source.MergedInto != "" {
+		dataMutex.Unlock()
+		http.Error(w, "Unknown draw or organizer link to merge", http.StatusBadRequest)
+		return
+	}
+	if draw.DrawDone || source.DrawDone {
+		dataMutex.Unlock()
+		http.Error(w, "Draws can only be merged before they are done", http.StatusConflict)
+		return
+	}
+	if draw.OriginalNames != nil || source.OriginalNames != nil {
+		dataMutex.Unlock()
+		http.Error(w, "Reveal the names of both draws before merging them", http.StatusConflict)
+		return
+	}
+	for _, incoming := range source.Participants {
+		for _, existing := range draw.Participants {
+			if strings.EqualFold(incoming.Name, existing.Name) {
+				dataMutex.Unlock()
+				http.Error(w, fmt.Sprintf("Both draws have a participant named %s", incoming.Name), http.StatusConflict)
+				return
+			}
+		}
+	}
+	total := len(draw.activeParticipants()) + len(source.activeParticipants())
+	if total > maxParticipants || len(draw.Participants)+len(source.Participants) > maxParticipantRows {
+		dataMutex.Unlock()
+		http.Error(w, fmt.Sprintf("Together the draws have more than %d participants", maxParticipants), http.StatusConflict)
+		return
+	}
+
+	for token, p := range source.Participants {
+		draw.Participants[token] = p
+		delete(source.Participants, token)
+	}
+	for _, hash := range source.BannedIPs {
+		if !slices.Contains(draw.BannedIPs, hash) {
+			draw.BannedIPs = append(draw.BannedIPs, hash)
+		}
+	}
+	if draw.ExpectedParticipants != nil && total > *draw.ExpectedParticipants {
+		expected := total
+		draw.ExpectedParticipants = &expected
+	}
+	draw.participantCount.Store(int32(total))
+	source.participantCount.Store(0)
+	source.Pins = nil
+	source.MergedInto = id
+	addAudit(draw, "merge", "from "+source.Name)
+	addAudit(source, "merge", "into "+draw.Name)
+	notifySubscribers(id, draw)
+	notifySubscribers(sourceID, source)
+	saveDataUnsafe()
+	dataMutex.Unlock()
+
+	if !wantsJSON(r) {
+		http.Redirect(w, r, "/draw/"+id+"/manage?organizer="+draw.OrganizerToken, http.StatusSeeOther)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// pinsHandler lets the organizer fix giver -> receiver pairs before the draw.
+// GET lists the pins, POST with giver and receiver tokens adds one and POST
+// with remove={giver token} deletes it. The rest of the draw stays random.
+func pinsHandler(w http.ResponseWriter, r *http.Request, id string, draw *Draw) {
+	if !draw.isOrganizer(r.URL.Query().Get("organizer")) {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		type pin struct {
+			Giver        string `json:"giver"`
+			GiverName    string `json:"giverName"`
+			Receiver     string `json:"receiver"`
+			ReceiverName string `json:"receiverName"`
+		}
+		dataMutex.RLock()
+		pins := make([]pin, 0, len(draw.Pins))
+		for giver, receiver := range draw.Pins {
+			pins = append(pins, pin{giver, draw.Participants[giver].Name, receiver, draw.Participants[receiver].Name})
+		}
+		dataMutex.RUnlock()
+		sort.Slice(pins, func(i, j int) bool { return pins[i].GiverName < pins[j].GiverName })
+		writeJSON(w, http.StatusOK, pins)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+
+	dataMutex.Lock()
+	if draw.DrawDone {
+		dataMutex.Unlock()
+		http.Error(w, "The draw is already done", http.StatusConflict)
+		return
+	}
+	if giver := r.FormValue("remove"); giver != "" {
+		delete(draw.Pins, giver)
+	} else {
+		giver, receiver := r.FormValue("giver"), r.FormValue("receiver")
+		pins := make(map[string]string, len(draw.Pins)+1)
+		for g, rec := range draw.Pins {
+			pins[g] = rec
+		}
+		pins[giver] = receiver
+		// Following the pins from the receiver must not lead back to the giver,
+		// a closed loop can't be part of the single gift cycle
+		loop := false
+		for t := pins[receiver]; t != "" && !loop; t = pins[t] {
+			loop = t == giver
+		}
+		if err := checkPins(draw.activeParticipants(), pins); err != nil || loop {
+			dataMutex.Unlock()
+			http.Error(w, errInfeasiblePins.Error(), http.StatusConflict)
+			return
+		}
+		draw.Pins = pins
+		addAudit(draw, "pin", draw.Participants[giver].Name+" -> "+draw.Participants[receiver].Name)
+	}
+	saveDataUnsafe()
+	dataMutex.Unlock()
+
+	if !wantsJSON(r) {
+		// Sent from the manage page form
+		http.Redirect(w, r, "/draw/"+id+"/manage?organizer="+draw.OrganizerToken, http.StatusSeeOther)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// photoSlots bounds the photos being decoded at once. Even within
+// maxPhotoPixels a decoded image takes up to 16 MB and resizeToFit visits
+// every pixel, while the result is only a photoSize avatar.
+var photoSlots = make(chan struct{}, 2)
+
+// photoHandler serves (GET) or replaces (POST) a participant's profile photo.
+// Holding the participant token is what authorizes the upload.
+func photoHandler(w http.ResponseWriter, r *http.Request, id string, draw *Draw, token string) {
+	dataMutex.RLock()
+	p, ok := draw.Participants[token]
+	photo := ""
+	if ok {
+		photo = p.Photo
+	}
+	dataMutex.RUnlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if photo == "" {
+			http.NotFound(w, r)
+			return
+		}
+		data, err := base64.StdEncoding.DecodeString(photo)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Header().Set("Cache-Control", "private, max-age=300")
+		w.Write(data)
+
+	case http.MethodPost:
+		r.Body = http.MaxBytesReader(w, r.Body, maxPhotoBytes+4096) // room for the multipart headers
+		file, _, err := r.FormFile("photo")
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Photo is missing or too large (max %d KB)", maxPhotoBytes>>10), http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+
+		data, err := io.ReadAll(io.LimitReader(file, maxPhotoBytes+1))
+		if err != nil || len(data) > maxPhotoBytes {
+			http.Error(w, fmt.Sprintf("Photo is too large (max %d KB)", maxPhotoBytes>>10), http.StatusBadRequest)
+			return
+		}
+		// Check the actual bytes rather than the client-supplied content type
+		contentType := http.DetectContentType(data)
+		if contentType != "image/jpeg" && contentType != "image/png" {
+			http.Error(w, "Photo must be a JPEG or PNG image", http.StatusBadRequest)
+			return
+		}
+		// Read the dimensions from the header before decoding, which allocates
+		// the whole image
+		config, _, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			http.Error(w, "Photo could not be read", http.StatusBadRequest)
+			return
+		}
+		if config.Width > maxPhotoPixels || config.Height > maxPhotoPixels {
+			http.Error(w, fmt.Sprintf("Photo is too large (max %dx%d pixels)", maxPhotoPixels, maxPhotoPixels), http.StatusBadRequest)
+			return
+		}
+		select {
+		case photoSlots <- struct{}{}:
+		default:
+			w.Header().Set("Retry-After", "2")
+			http.Error(w, "Too many photos being processed. Please try again in a few seconds.", http.StatusServiceUnavailable)
+			return
+		}
+		img, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			<-photoSlots
+			http.Error(w, "Photo could not be read", http.StatusBadRequest)
+			return
+		}
+		var buf bytes.Buffer
+		err = jpeg.Encode(&buf, resizeToFit(img, photoSize), &jpeg.Options{Quality: 85})
+		<-photoSlots
+		if err != nil {
+			http.Error(w, "Photo could not be processed", http.StatusInternalServerError)
+			return
+		}
+
+		dataMutex.Lock()
+		p.Photo = base64.StdEncoding.EncodeToString(buf.Bytes())
+		dataMutex.Unlock()
+		saveData()
+		http.Redirect(w, r, "/draw/"+id+"/participant/"+token, http.StatusSeeOther)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// optOutHandler lets a participant withdraw before the draw. They stay in the
+// map, so their link keeps working, but they are left out of the draw and free
+// up their spot. The organizer's manage page reloads through the event stream.
+func optOutHandler(w http.ResponseWriter, r *http.Request, id string, draw *Draw, token string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	dataMutex.Lock()
+	p, ok := draw.Participants[token]
+	if !ok {
+		dataMutex.Unlock()
+		http.NotFound(w, r)
+		return
+	}
+	if draw.DrawDone {
+		dataMutex.Unlock()
+		http.Error(w, "The draw is already done", http.StatusConflict)
+		return
+	}
+	if token == draw.OrganizerToken {
+		dataMutex.Unlock()
+		http.Error(w, "The organizer can't opt out of their own draw", http.StatusConflict)
+		return
+	}
+	if p.Pending {
+		dataMutex.Unlock()
+		http.Error(w, "Joins awaiting approval can't opt out", http.StatusConflict)
+		return
+	}
+	if !p.OptedOut {
+		now := timeNow()
+		p.OptedOut = true
+		p.OptedOutAt = &now
+		// Their pins can't be honoured any more
+		for giver, receiver := range draw.Pins {
+			if giver == token || receiver == token {
+				delete(draw.Pins, giver)
+			}
 		}
+		draw.participantCount.Add(-1)
+		addAudit(draw, "opt-out", p.Name)
+		notifySubscribers(id, draw)
+		saveDataUnsafe()
 	}
-	return -1
+	dataMutex.Unlock()
+
+	if !wantsJSON(r) {
+		http.Redirect(w, r, "/draw/"+id+"/participant/"+token, http.StatusSeeOther)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
 }
 
-func trimSpace(s string) string {
-	start := 0
-	end := len(s)
-	for start < end && (s[start] == ' ' || s[start] == '\t') {
-		start++
+// submitWishHandler lets a participant who hasn't submitted yet, such as an
+// organizer who chose to add their wish later, send their wish and ideas
+// through POST /draw/{id}/participant/{token}/submit. It counts them as submitted.
+func submitWishHandler(w http.ResponseWriter, r *http.Request, id string, draw *Draw, token string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
-	for end > start && (s[end-1] == ' ' || s[end-1] == '\t') {
-		end--
+
+	wish := normalizeWish(r.FormValue("wish"))
+	if limit := draw.wishLimit(); utf8.RuneCountInString(wish) > limit {
+		http.Error(w, fmt.Sprintf("Wish is too long (max %d characters)", limit), http.StatusBadRequest)
+		return
+	}
+	giftIdeas, err := parseGiftIdeas(r.FormValue("ideas"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dataMutex.Lock()
+	p, ok := draw.Participants[token]
+	if !ok {
+		dataMutex.Unlock()
+		http.NotFound(w, r)
+		return
+	}
+	if draw.DrawDone || p.Submitted || p.Pending || p.OptedOut {
+		dataMutex.Unlock()
+		http.Error(w, "There is nothing left to submit", http.StatusConflict)
+		return
+	}
+	p.Wish = wish
+	p.GiftIdeas = giftIdeas
+	p.Submitted = true
+	notifySubscribers(id, draw)
+	saveDataUnsafe()
+	dataMutex.Unlock()
+
+	if !wantsJSON(r) {
+		http.Redirect(w, r, "/draw/"+id+"/participant/"+token, http.StatusSeeOther)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// giftBoughtHandler records what a giver actually bought, for their own
+// reference. Only the holder of the participant token can read or change it.
+func giftBoughtHandler(w http.ResponseWriter, r *http.Request, id string, draw *Draw, token string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	dataMutex.Lock()
+	p, ok := draw.Participants[token]
+	done := draw.DrawDone
+	dataMutex.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if !done {
+		http.Error(w, "The draw hasn't happened yet", http.StatusConflict)
+		return
+	}
+
+	note := strings.TrimSpace(r.FormValue("giftbought"))
+	if utf8.RuneCountInString(note) > maxGiftBought {
+		http.Error(w, fmt.Sprintf("Gift note is too long (max %d characters)", maxGiftBought), http.StatusBadRequest)
+		return
+	}
+
+	dataMutex.Lock()
+	p.GiftBought = note
+	dataMutex.Unlock()
+	saveData()
+
+	if !wantsJSON(r) {
+		http.Redirect(w, r, "/draw/"+id+"/participant/"+token, http.StatusSeeOther)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// resizeToFit scales img down so it fits in a size x size square, keeping its
+// aspect ratio. Each target pixel is the average of the source pixels it covers.
+func resizeToFit(img image.Image, size int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= size && h <= size {
+		return img
+	}
+	tw, th := size, size
+	if w > h {
+		th = max(1, h*size/w)
+	} else {
+		tw = max(1, w*size/h)
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, tw, th))
+	for y := 0; y < th; y++ {
+		y0, y1 := b.Min.Y+y*h/th, b.Min.Y+(y+1)*h/th
+		for x := 0; x < tw; x++ {
+			x0, x1 := b.Min.X+x*w/tw, b.Min.X+(x+1)*w/tw
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					r, g, bl, a, n = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca), n+1
+				}
+			}
+			dst.Set(x, y, color.RGBA64{uint16(r / n), uint16(g / n), uint16(bl / n), uint16(a / n)})
+		}
+	}
+	return dst
+}
+
+// HealthStatus is the body of /healthz/detailed. The store fields help
+// diagnose slow disks, no draw contents are included.
+type HealthStatus struct {
+	StorageReadable bool       `json:"storageReadable"`
+	StorageWritable bool       `json:"storageWritable"`
+	TemplatesLoaded bool       `json:"templatesLoaded"`
+	LocalesLoaded   []string   `json:"localesLoaded"`
+	ActiveDrawCount int        `json:"activeDrawCount"`
+	MemoryUsageMB   float64    `json:"memoryUsageMB"`
+	GoroutineCount  int        `json:"goroutineCount"`
+	Uptime          string     `json:"uptime"`
+	DryRun          bool       `json:"dryRun"`
+	StoreType       string     `json:"storeType"`
+	LastSaveAt      *time.Time `json:"lastSaveAt"`
+	ReadLatencyMS   float64    `json:"readLatencyMs"`
+	WriteLatencyMS  float64    `json:"writeLatencyMs"`
+}
+
+// storageReadable reports whether the data file can be read. A missing file
+// is fine, it is created on the first save. DRY_RUN never touches the file.
+func storageReadable() bool {
+	if dryRunMode {
+		return true
+	}
+	f, err := os.Open(dataFile)
+	if os.IsNotExist(err) {
+		return true
+	}
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	_, err = f.Read(make([]byte, 1))
+	return err == nil || err == io.EOF
+}
+
+// storageWritable reports whether a file can be created next to the data file.
+// DRY_RUN never touches the file.
+func storageWritable() bool {
+	if dryRunMode {
+		return true
+	}
+	f, err := os.CreateTemp(filepath.Dir(dataFile), ".healthz-*")
+	if err != nil {
+		return false
+	}
+	f.Close()
+	return os.Remove(f.Name()) == nil
+}
+
+func templatesLoaded() bool {
+	return templates.Lookup("create_event.html") != nil
+}
+
+// versionHandler reports the build version as JSON
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, struct {
+		Version string `json:"version"`
+	}{version})
+}
+
+// healthHandler answers load balancer checks with {"status": "ok"} or a 503
+// {"status": "unhealthy"}. dryRun tells monitoring the data is never saved.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	status, code := "ok", http.StatusOK
+	if !storageReadable() || !templatesLoaded() {
+		status, code = "unhealthy", http.StatusServiceUnavailable
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, code, struct {
+		Status string `json:"status"`
+		DryRun bool   `json:"dryRun"`
+	}{status, dryRunMode})
+}
+
+// healthDetailedHandler reports a HealthStatus when ?secret= matches
+// HEALTH_SECRET. It is disabled when no secret is configured.
+func healthDetailedHandler(w http.ResponseWriter, r *http.Request) {
+	secret := os.Getenv("HEALTH_SECRET")
+	if secret == "" || subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("secret")), []byte(secret)) != 1 {
+		http.NotFound(w, r)
+		return
+	}
+
+	status := HealthStatus{
+		TemplatesLoaded: templatesLoaded(),
+		LocalesLoaded:   []string{},
+		GoroutineCount:  runtime.NumGoroutine(),
+		Uptime:          time.Since(startTime).Round(time.Second).String(),
+		DryRun:          dryRunMode,
+		StoreType:       "json-file",
+	}
+	if dryRunMode {
+		status.StoreType = "dry-run"
+	}
+	start := time.Now()
+	status.StorageReadable = storageReadable()
+	status.ReadLatencyMS = float64(time.Since(start).Microseconds()) / 1000
+	start = time.Now()
+	status.StorageWritable = storageWritable()
+	status.WriteLatencyMS = float64(time.Since(start).Microseconds()) / 1000
+	for _, lang := range supportedLanguages {
+		if readLocale(lang) != nil {
+			status.LocalesLoaded = append(status.LocalesLoaded, lang)
+		}
+	}
+	dataMutex.RLock()
+	status.ActiveDrawCount = len(appData.Events)
+	if !lastSaveAt.IsZero() {
+		saved := lastSaveAt
+		status.LastSaveAt = &saved
+	}
+	dataMutex.RUnlock()
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	status.MemoryUsageMB = float64(mem.Alloc) / (1 << 20)
+
+	code := http.StatusOK
+	if !status.StorageReadable || !status.StorageWritable || !status.TemplatesLoaded {
+		code = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, code, status)
+}
+
+// Page sizes of /admin/events
+const (
+	defaultEventsPage = 100
+	maxEventsPage     = 500
+)
+
+// adminEventsHandler lists all draws, newest first, without participant
+// details. ?tag= keeps only the draws with that tag. The list is paged with
+// ?limit= (at most maxEventsPage) and ?offset=, the X-Total-Count header has
+// the number of draws before paging.
+func adminEventsHandler(w http.ResponseWriter, r *http.Request) {
+	type event struct {
+		ID           string    `json:"id"`
+		Name         string    `json:"name"`
+		CreatedAt    time.Time `json:"createdAt"`
+		Participants int       `json:"participants"`
+		DrawDone     bool      `json:"drawDone"`
+		Tags         []string  `json:"tags"`
+	}
+
+	limit, offset := defaultEventsPage, 0
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxEventsPage {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxEventsPage), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	if v := r.URL.Query().Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "offset must be a non-negative number", http.StatusBadRequest)
+			return
+		}
+		offset = n
+	}
+
+	tag := strings.ToLower(r.URL.Query().Get("tag"))
+	events := []event{}
+	dataMutex.RLock()
+	if tag != "" {
+		for id := range tagIndex[tag] {
+			draw := appData.Events[id]
+			events = append(events, event{id, draw.Name, draw.CreatedAt, len(draw.Participants), draw.DrawDone, append([]string{}, draw.Tags...)})
+		}
+	} else {
+		for id, draw := range appData.Events {
+			events = append(events, event{id, draw.Name, draw.CreatedAt, len(draw.Participants), draw.DrawDone, append([]string{}, draw.Tags...)})
+		}
+	}
+	dataMutex.RUnlock()
+	// The ID breaks ties so pages don't overlap when draws share a creation time
+	sort.Slice(events, func(i, j int) bool {
+		if !events[i].CreatedAt.Equal(events[j].CreatedAt) {
+			return events[i].CreatedAt.After(events[j].CreatedAt)
+		}
+		return events[i].ID < events[j].ID
+	})
+	w.Header().Set("X-Total-Count", strconv.Itoa(len(events)))
+	start := min(offset, len(events))
+	writeJSON(w, http.StatusOK, events[start:min(start+limit, len(events))])
+}
+
+// adminRestoreHandler lists the data file backups on GET. On POST it replaces
+// all draws with the content of ?backup={name}, which also needs ?confirm=yes.
+// The backup must parse and match its checksum; the current data is saved over
+// as usual, so with BACKUP_ON_WRITE it is itself backed up first.
+func adminRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	if dryRunMode {
+		http.Error(w, "Backups are not available in DRY_RUN mode", http.StatusConflict)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		type backup struct {
+			Name    string    `json:"name"`
+			Size    int64     `json:"size"`
+			SavedAt time.Time `json:"savedAt"`
+		}
+		backups := []backup{}
+		for _, path := range listBackups() {
+			info, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+			backups = append(backups, backup{filepath.Base(path), info.Size(), info.ModTime()})
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, http.StatusOK, backups)
+
+	case http.MethodPost:
+		name := r.URL.Query().Get("backup")
+		path := ""
+		for _, candidate := range listBackups() {
+			if filepath.Base(candidate) == name {
+				path = candidate
+			}
+		}
+		if path == "" {
+			http.Error(w, "Unknown backup", http.StatusNotFound)
+			return
+		}
+		if r.URL.Query().Get("confirm") != "yes" {
+			http.Error(w, "Restoring replaces every draw, add confirm=yes to go ahead", http.StatusBadRequest)
+			return
+		}
+
+		bytes, err := os.ReadFile(path)
+		if err != nil {
+			http.Error(w, "Backup can't be read", http.StatusInternalServerError)
+			return
+		}
+		var restored Data
+		if err := json.Unmarshal(bytes, &restored); err != nil || restored.Events == nil {
+			http.Error(w, "Backup is not a valid data file", http.StatusUnprocessableEntity)
+			return
+		}
+		for _, draw := range restored.Events {
+			if draw == nil || draw.Participants == nil {
+				http.Error(w, "Backup is not a valid data file", http.StatusUnprocessableEntity)
+				return
+			}
+		}
+		if stored, sum := fileChecksum(bytes); stored != "" {
+			if sum != stored {
+				http.Error(w, "Backup checksum mismatch, it was modified outside of the app", http.StatusUnprocessableEntity)
+				return
+			}
+		}
+
+		dataMutex.Lock()
+		previous := len(appData.Events)
+		appData = restored
+		prepareDraws()
+		indexTags()
+		anomalies := verifyData()
+		saveDataUnsafe()
+		for id, draw := range appData.Events {
+			notifySubscribers(id, draw)
+		}
+		dataMutex.Unlock()
+		log.Printf("Restored %d draws from backup %s, replacing %d", len(restored.Events), name, previous)
+
+		writeJSON(w, http.StatusOK, struct {
+			Draws     int       `json:"draws"`
+			Anomalies []Anomaly `json:"anomalies"`
+		}{len(restored.Events), anomalies})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
-	return s[start:end]
 }
 
-func loadTranslations(lang string) Translations {
-	if lang == "" {
-		lang = "en"
-	}
-	filename := fmt.Sprintf("locales/%s.json", lang)
-	file, err := os.Open(filename)
-	if err != nil {
-		file, _ = os.Open("locales/en.json") // fallback
+// requireAdmin checks HTTP Basic Auth credentials against ADMIN_USER (default "admin")
+// and ADMIN_PASSWORD. Admin endpoints are disabled when no password is configured.
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	password := os.Getenv("ADMIN_PASSWORD")
+	if password == "" {
+		http.NotFound(w, r)
+		return false
 	}
-	if file != nil {
-		defer file.Close()
+	expectedUser := os.Getenv("ADMIN_USER")
+	if expectedUser == "" {
+		expectedUser = "admin"
 	}
-	bytes, _ := io.ReadAll(file)
-	var t Translations
-	json.Unmarshal(bytes, &t)
-	return t
-}
 
-func homeHandler(w http.ResponseWriter, r *http.Request) {
-	lang := getLanguage(r)
-	t := loadTranslations(lang)
-	canonical := fmt.Sprintf("https://%s/", r.Host)
-	templates.ExecuteTemplate(w, "create_event.html", struct {
-		T           Translations
-		CurrentLang string
-		Canonical   string
-	}{t, lang, canonical})
+	user, pass, ok := r.BasicAuth()
+	if !ok ||
+		subtle.ConstantTimeCompare([]byte(user), []byte(expectedUser)) != 1 ||
+		subtle.ConstantTimeCompare([]byte(pass), []byte(password)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="admin"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
 }
 
-func createDrawHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method == http.MethodGet {
-		// Redirect to root - content is served at /
-		http.Redirect(w, r, "/", http.StatusMovedPermanently)
+func adminHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
 		return
 	}
-	r.ParseForm()
-	eventName := r.FormValue("eventname")
-	organizerName := r.FormValue("organizername")
-	organizerWish := r.FormValue("organizerwish")
-	expected := r.FormValue("expected")
 
-	// Validate inputs
-	eventName, err := validateInput(eventName, maxNameLength, "Draw name")
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if r.URL.Path == "/admin/verify" {
+		dataMutex.RLock()
+		drawCount := len(appData.Events)
+		anomalies := verifyData()
+		dataMutex.RUnlock()
+		writeJSON(w, http.StatusOK, struct {
+			Draws     int       `json:"draws"`
+			Anomalies []Anomaly `json:"anomalies"`
+		}{drawCount, anomalies})
 		return
 	}
 
-	organizerName, err = validateInput(organizerName, maxNameLength, "Organizer name")
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if r.URL.Path == "/admin/events" {
+		adminEventsHandler(w, r)
 		return
 	}
 
-	// Wish is optional but has max length if provided
-	if organizerWish != "" {
-		if len(organizerWish) > maxWishLength {
-			http.Error(w, fmt.Sprintf("Wish is too long (max %d characters)", maxWishLength), http.StatusBadRequest)
-			return
-		}
-	}
-
-	// Validate expected participants
-	expectedNum := 0
-	fmt.Sscanf(expected, "%d", &expectedNum)
-	if expectedNum < 3 || expectedNum > 50 {
-		http.Error(w, "Expected participants must be between 3 and 50", http.StatusBadRequest)
+	if r.URL.Path == "/admin/restore" {
+		adminRestoreHandler(w, r)
 		return
 	}
 
-	// Check if we've hit the max active events limit
-	dataMutex.RLock()
-	activeEvents := len(appData.Events)
-	dataMutex.RUnlock()
-
-	if activeEvents >= maxActiveEvents {
-		http.Error(w, "Server is at capacity. Please try again later.", http.StatusServiceUnavailable)
+	// /admin/draws/{id}/{action}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/admin/"), "/")
+	if len(parts) != 3 || parts[0] != "draws" {
+		http.NotFound(w, r)
 		return
 	}
-
-	id := generateSecureToken()
-	organizerToken := generateSecureToken()
-
-	dataMutex.Lock()
-	appData.Events[id] = &Draw{
-		Name:                 eventName,
-		ExpectedParticipants: &expectedNum,
-		Participants: map[string]*Participant{
-			organizerToken: {
-				Name:      organizerName,
-				Wish:      organizerWish,
-				Submitted: true,
-			},
-		},
-		DrawDone:  false,
-		CreatedAt: time.Now(),
-	}
-	dataMutex.Unlock()
-	saveData()
-
-	// Redirect to manage page with organizer's participant token in query
-	http.Redirect(w, r, "/draw/"+id+"/manage?organizer="+organizerToken, http.StatusSeeOther)
-}
-
-func drawHandler(w http.ResponseWriter, r *http.Request) {
-	path := r.URL.Path[len("/draw/"):] // /{id}/...
-
-	// Extract draw ID (everything before the first slash or the whole string)
-	var id string
-	slashIndex := strings.Index(path, "/")
-	if slashIndex == -1 {
-		id = path
-	} else {
-		id = path[:slashIndex]
-	}
+	id, action := parts[1], parts[2]
 
 	dataMutex.RLock()
 	draw, ok := appData.Events[id]
 	dataMutex.RUnlock()
-
 	if !ok {
 		http.NotFound(w, r)
 		return
 	}
 
-	lang := getLanguage(r)
-	t := loadTranslations(lang)
-
-	// Extract action from path (e.g., "join", "manage", "participant/{token}", "draw")
-	action := ""
-	if slashIndex != -1 && slashIndex+1 < len(path) {
-		action = path[slashIndex+1:]
-	}
-
-	// Handle participant/{token} specially
-	if len(action) > 12 && action[:12] == "participant/" {
-		token := action[12:] // Extract token after "participant/"
-
+	switch action {
+	case "replay":
+		// Recompute the assignment for a recorded seed without touching the draw,
+		// so the organizer can prove the result came from that shuffle.
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		seedHex := r.URL.Query().Get("seed")
+		seed, err := parseSeed(seedHex)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !acquireDrawSlot(w) {
+			return
+		}
+		defer releaseDrawSlot()
 		dataMutex.RLock()
-		p, ok := draw.Participants[token]
+		snapshot := draw.shuffleSnapshot()
+		history := slices.Clone(draw.ShuffleHistory)
 		dataMutex.RUnlock()
-		if !ok {
-			http.NotFound(w, r)
+		assignment, err := assignGifts(snapshot, seed)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
 			return
 		}
-		if !draw.DrawDone {
-			canonical := fmt.Sprintf("https://%s%s", r.Host, r.URL.Path)
-			templates.ExecuteTemplate(w, "participant.html", struct {
-				Name        string
-				Ready       bool
-				T           Translations
-				CurrentLang string
-				Canonical   string
-			}{p.Name, false, t, lang, canonical})
-		} else {
-			// Find the wish of the person they're giving a gift to
-			recipientWish := ""
-			for _, participant := range draw.Participants {
-				if participant.Name == p.GiftFor {
-					recipientWish = participant.Wish
-					break
-				}
+		hash := assignmentHash(snapshot.Participants, assignment)
+		matches := false
+		for _, record := range history {
+			if record.SeedHex == seedHex && record.AssignmentHash == hash {
+				matches = true
+				break
 			}
-			canonical := fmt.Sprintf("https://%s%s", r.Host, r.URL.Path)
-			templates.ExecuteTemplate(w, "participant.html", struct {
-				Name        string
-				Ready       bool
-				GiftFor     string
-				Wish        string
-				T           Translations
-				CurrentLang string
-				Canonical   string
-			}{p.Name, true, p.GiftFor, recipientWish, t, lang, canonical})
 		}
-		return
-	}
+		writeJSON(w, http.StatusOK, struct {
+			SeedHex        string `json:"seedHex"`
+			AssignmentHash string `json:"assignmentHash"`
+			MatchesHistory bool   `json:"matchesHistory"`
+		}{seedHex, hash, matches})
 
-	switch action {
-	case "join":
-		if r.Method == http.MethodGet {
-			canonical := fmt.Sprintf("https://%s%s", r.Host, r.URL.Path)
-			templates.ExecuteTemplate(w, "join.html", struct {
-				EventID     string
-				T           Translations
-				CurrentLang string
-				Canonical   string
-			}{id, t, lang, canonical})
+	case "reassign":
+		// Emergency manual override of the assignments, e.g. after data corruption.
+		// Receivers are given by token, names aren't unique.
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
-		r.ParseForm()
-
-		// Check if draw has reached participant limit
-		dataMutex.RLock()
-		isFull := draw.ExpectedParticipants != nil && len(draw.Participants) >= *draw.ExpectedParticipants
-		dataMutex.RUnlock()
-
-		if isFull {
-			http.Error(w, "Draw is full - maximum participants reached", http.StatusForbidden)
+		var changes []struct {
+			GiverToken    string `json:"giverToken"`
+			ReceiverToken string `json:"receiverToken"`
+		}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&changes); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
 			return
 		}
 
-		name := r.FormValue("name")
-		wish := r.FormValue("wish")
+		dataMutex.Lock()
+		defer dataMutex.Unlock()
 
-		// Validate inputs
-		name, err := validateInput(name, maxNameLength, "Name")
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+		if !draw.DrawDone {
+			http.Error(w, "Draw has not been done yet", http.StatusConflict)
+			return
+		}
+		active := draw.activeParticipants()
+		if len(changes) != len(active) {
+			http.Error(w, "Every participant must appear exactly once as a giver", http.StatusBadRequest)
 			return
 		}
 
-		// Wish is optional but has max length if provided
-		if wish != "" {
-			if len(wish) > maxWishLength {
-				http.Error(w, fmt.Sprintf("Wish is too long (max %d characters)", maxWishLength), http.StatusBadRequest)
+		// Every participant gives exactly once and receives exactly once
+		givers := make(map[string]bool, len(changes))
+		receivers := make(map[string]bool, len(changes))
+		for _, c := range changes {
+			if _, ok := active[c.GiverToken]; !ok || givers[c.GiverToken] {
+				http.Error(w, "Every participant must appear exactly once as a giver", http.StatusBadRequest)
+				return
+			}
+			if _, ok := active[c.ReceiverToken]; !ok || receivers[c.ReceiverToken] {
+				http.Error(w, "Every participant must appear exactly once as a receiver", http.StatusBadRequest)
 				return
 			}
+			if c.GiverToken == c.ReceiverToken {
+				http.Error(w, "A participant cannot give a gift to themselves", http.StatusBadRequest)
+				return
+			}
+			givers[c.GiverToken] = true
+			receivers[c.ReceiverToken] = true
 		}
 
-		token := generateSecureToken()
+		for _, c := range changes {
+			giver, receiver := draw.Participants[c.GiverToken], draw.Participants[c.ReceiverToken].Name
+			if giver.GiftFor != receiver {
+				addAudit(draw, "reassign", fmt.Sprintf("%s: %s -> %s", giver.Name, giver.GiftFor, receiver))
+				giver.GiftFor = receiver
+			}
+		}
+		draw.ManuallyAdjusted = true
+		saveDataUnsafe()
+		w.WriteHeader(http.StatusNoContent)
 
-		dataMutex.Lock()
-		draw.Participants[token] = &Participant{Name: name, Wish: wish, Submitted: true}
-		dataMutex.Unlock()
+	default:
+		http.NotFound(w, r)
+	}
+}
 
-		saveData()
-		http.Redirect(w, r, "/draw/"+id+"/participant/"+token, http.StatusSeeOther)
+// Anomaly is an inconsistency found in the stored data by verifyData
+type Anomaly struct {
+	DrawID      string `json:"drawId"`
+	Participant string `json:"participant,omitempty"`
+	Issue       string `json:"issue"`
+}
 
-	case "manage":
-		dataMutex.RLock()
-		allSubmitted := true
-		for _, part := range draw.Participants {
-			if !part.Submitted {
-				allSubmitted = false
-				break
-			}
-		}
+// verifyData scans every draw for inconsistencies and reports them without
+// modifying anything.
+// Note: This function should be called when dataMutex is already locked
+func verifyData() []Anomaly {
+	anomalies := []Anomaly{}
+	report := func(id, participant, issue string) {
+		anomalies = append(anomalies, Anomaly{DrawID: id, Participant: participant, Issue: issue})
+	}
 
-		// Check if expected number of participants is reached
-		expectedReached := false
-		if draw.ExpectedParticipants != nil {
-			expectedReached = len(draw.Participants) >= *draw.ExpectedParticipants
+	for id, draw := range appData.Events {
+		if draw.ExpectedParticipants == nil {
+			report(id, "", "missing expected participant count")
+		}
+		active := draw.activeParticipants()
+		if draw.ExpectedParticipants != nil && len(active) > *draw.ExpectedParticipants {
+			report(id, "", fmt.Sprintf("%d participants but only %d expected", len(active), *draw.ExpectedParticipants))
+		}
+		if draw.CreatedAt.IsZero() {
+			report(id, "", "missing creation date")
 		}
-		dataMutex.RUnlock()
 
-		scheme := "https"
-		if isLocalHost(r.Host) {
-			scheme = "http"
+		names := make(map[string]int, len(draw.Participants))
+		for _, p := range draw.Participants {
+			names[p.Name]++
 		}
-		joinLink := fmt.Sprintf(scheme+"://%s/draw/%s/join", r.Host, id)
-		organizerToken := r.URL.Query().Get("organizer")
-		organizerLink := ""
-		organizerGiftFor := ""
-		organizerRecipientWish := ""
-		organizerName := ""
-		if organizerToken != "" && draw.DrawDone {
-			organizerLink = fmt.Sprintf(scheme+"://%s/draw/%s/participant/%s", r.Host, id, organizerToken)
-			if org, ok := draw.Participants[organizerToken]; ok {
-				organizerName = org.Name
-				organizerGiftFor = org.GiftFor
-				for _, p := range draw.Participants {
-					if p.Name == org.GiftFor {
-						organizerRecipientWish = p.Wish
-						break
-					}
-				}
+		for name, count := range names {
+			if count > 1 {
+				report(id, name, fmt.Sprintf("name used by %d participants", count))
 			}
 		}
-		canDraw := allSubmitted && !draw.DrawDone && expectedReached
-		canonical := fmt.Sprintf("https://%s%s", r.Host, r.URL.Path)
-		expectedCount := 0
-		if draw.ExpectedParticipants != nil {
-			expectedCount = *draw.ExpectedParticipants
-		}
-		templates.ExecuteTemplate(w, "manage.html", struct {
-			EventID                string
-			EventName              string
-			JoinLink               string
-			OrganizerLink          string
-			OrganizerToken         string
-			OrganizerName          string
-			OrganizerGiftFor       string
-			OrganizerRecipientWish string
-			Participants           map[string]*Participant
-			ExpectedCount          int
-			CanDraw                bool
-			DrawDone               bool
-			T                      Translations
-			CurrentLang            string
-			Canonical              string
-		}{id, draw.Name, joinLink, organizerLink, organizerToken, organizerName, organizerGiftFor, organizerRecipientWish, draw.Participants, expectedCount, canDraw, draw.DrawDone, t, lang, canonical})
 
-	case "draw":
-		if r.Method != http.MethodPost {
-			http.NotFound(w, r)
-			return
+		if !draw.DrawDone {
+			continue
 		}
-
-		dataMutex.Lock()
-		defer dataMutex.Unlock()
-
-		// Need at least 3 participants for a proper Secret Santa
-		if len(draw.Participants) < 3 {
-			http.Error(w, "Need at least 3 participants", http.StatusBadRequest)
-			return
+		if len(active) < minParticipants {
+			report(id, "", fmt.Sprintf("draw done with only %d participants", len(active)))
 		}
-
-		tokens := make([]string, 0, len(draw.Participants))
-		for t := range draw.Participants {
-			tokens = append(tokens, t)
+		received := make(map[string]int, len(active))
+		for _, p := range active {
+			if !p.Submitted {
+				report(id, p.Name, "not submitted in a done draw")
+			}
+			switch {
+			case p.GiftFor == "":
+				report(id, p.Name, "draw done but no recipient assigned")
+			case p.GiftFor == p.Name:
+				report(id, p.Name, "assigned to themselves")
+			case names[p.GiftFor] == 0:
+				report(id, p.Name, "assigned to an unknown participant")
+			default:
+				received[p.GiftFor]++
+			}
 		}
-		mathrand.Shuffle(len(tokens), func(i, j int) { tokens[i], tokens[j] = tokens[j], tokens[i] })
-		n := len(tokens)
-		for i, t := range tokens {
-			next := tokens[(i+1)%n]
-			draw.Participants[t].GiftFor = draw.Participants[next].Name
+		for _, p := range active {
+			if received[p.Name] != 1 {
+				report(id, p.Name, fmt.Sprintf("receives %d gifts", received[p.Name]))
+			}
 		}
-		draw.DrawDone = true
-		saveDataUnsafe()
+	}
 
-		// Redirect back to manage page, preserving organizer token if present
-		organizerToken := r.URL.Query().Get("organizer")
-		redirectURL := "/draw/" + id + "/manage"
-		if organizerToken != "" {
-			redirectURL += "?organizer=" + organizerToken
+	sort.Slice(anomalies, func(i, j int) bool {
+		if anomalies[i].DrawID != anomalies[j].DrawID {
+			return anomalies[i].DrawID < anomalies[j].DrawID
 		}
-		http.Redirect(w, r, redirectURL, http.StatusSeeOther)
-
-	default:
-		http.NotFound(w, r)
-	}
+		return anomalies[i].Participant < anomalies[j].Participant
+	})
+	return anomalies
 }
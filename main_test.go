@@ -0,0 +1,2684 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"html"
+	"image"
+	"image/png"
+	"io"
+	"io/fs"
+	"log"
+	"log/slog"
+	mathrand "math/rand"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"secret-santa/ratelimit"
+)
+
+func TestMain(m *testing.M) {
+	// Handlers save after every change, keep that away from data.json
+	dryRunMode = true
+	appData.Events = make(map[string]*Draw)
+	os.Exit(m.Run())
+}
+
+// addTestDraw stores a draw under id with one submitted participant per name,
+// the participant tokens are "t-" + name. The first one is the organizer.
+func addTestDraw(t *testing.T, id string, names ...string) *Draw {
+	t.Helper()
+	expected := len(names)
+	draw := &Draw{
+		Name:                 "Test " + id,
+		ExpectedParticipants: &expected,
+		Participants:         make(map[string]*Participant),
+		CreatedAt:            timeNow(),
+		OrganizerToken:       "t-" + names[0],
+	}
+	for _, name := range names {
+		draw.Participants["t-"+name] = &Participant{Name: name, Wish: "socks", Submitted: true, JoinedAt: timeNow()}
+	}
+	draw.participantCount.Store(int32(len(names)))
+
+	dataMutex.Lock()
+	appData.Events[id] = draw
+	dataMutex.Unlock()
+	t.Cleanup(func() {
+		dataMutex.Lock()
+		delete(appData.Events, id)
+		dataMutex.Unlock()
+	})
+	return draw
+}
+
+func TestClientIP(t *testing.T) {
+	saved := trustedProxies
+	trustedProxies = parseTrustedProxies("10.0.0.0/8, 192.168.1.1")
+	defer func() { trustedProxies = saved }()
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		want       string
+	}{
+		{"direct", "203.0.113.5:1234", nil, "203.0.113.5"},
+		{"untrusted peer can't claim an address", "203.0.113.5:1234", map[string]string{"X-Forwarded-For": "1.2.3.4", "Fly-Client-IP": "1.2.3.4"}, "203.0.113.5"},
+		{"trusted proxy, Fly header", "10.1.2.3:80", map[string]string{"Fly-Client-IP": "198.51.100.7"}, "198.51.100.7"},
+		{"trusted proxy, right-most untrusted hop", "10.1.2.3:80", map[string]string{"X-Forwarded-For": "1.2.3.4, 198.51.100.7, 10.9.9.9"}, "198.51.100.7"},
+		{"single trusted address", "192.168.1.1:80", map[string]string{"X-Forwarded-For": "198.51.100.7"}, "198.51.100.7"},
+		{"only proxies in the chain", "10.1.2.3:80", map[string]string{"X-Forwarded-For": "10.4.4.4"}, "10.1.2.3"},
+		{"trusted proxy without headers", "10.1.2.3:80", nil, "10.1.2.3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			if got := clientIP(r); got != tt.want {
+				t.Errorf("clientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJoinCodes(t *testing.T) {
+	pattern := regexp.MustCompile(`^[A-Z]+-[A-Z]+-[A-Z]+-[A-Z]+-[1-9][0-9]{3}$`)
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		code := generateJoinCode()
+		if !pattern.MatchString(code) {
+			t.Fatalf("join code %q doesn't look like WORD-WORD-WORD-WORD-1234", code)
+		}
+		seen[code] = true
+	}
+	if len(seen) < 999 {
+		t.Errorf("only %d distinct codes out of 1000", len(seen))
+	}
+
+	draw := addTestDraw(t, "joincode", "Ann", "Ben", "Cat")
+	dataMutex.Lock()
+	draw.JoinCode = uniqueJoinCode()
+	other := uniqueJoinCode()
+	dataMutex.Unlock()
+	if other == draw.JoinCode {
+		t.Errorf("uniqueJoinCode returned the code of an existing draw")
+	}
+
+	saved := joinCodeLimiter
+	joinCodeLimiter = ratelimit.New(3, time.Minute)
+	defer func() { joinCodeLimiter = saved }()
+
+	resolve := func(code string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		joinCodeHandler(rec, httptest.NewRequest("GET", "/join?code="+url.QueryEscape(code), nil))
+		return rec
+	}
+	rec := resolve(" " + strings.ToLower(draw.JoinCode) + " ")
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/draw/joincode/join" {
+		t.Errorf("lower-case code: got %d to %q, want a redirect to the join page", rec.Code, rec.Header().Get("Location"))
+	}
+	if rec := resolve("PINE-OAK-STAR-WREN-1234"); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown code: got %d, want 404", rec.Code)
+	}
+	resolve(draw.JoinCode)
+	if rec := resolve(draw.JoinCode); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("4th lookup in a minute: got %d, want 429", rec.Code)
+	}
+}
+
+// uploadPhoto posts data as the photo of participant token in draw id
+func uploadPhoto(t *testing.T, id, token string, data []byte) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, _ := mw.CreateFormFile("photo", "photo.png")
+	part.Write(data)
+	mw.Close()
+	r := httptest.NewRequest("POST", "/draw/"+id+"/participants/"+token+"/photo", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	r.Header.Set("Accept", "application/json")
+	rec := httptest.NewRecorder()
+	drawHandler(rec, r)
+	return rec
+}
+
+func TestPhotoDimensions(t *testing.T) {
+	addTestDraw(t, "photo", "Ann", "Ben", "Cat")
+
+	var small bytes.Buffer
+	png.Encode(&small, image.NewRGBA(image.Rect(0, 0, 200, 150)))
+	if rec := uploadPhoto(t, "photo", "t-Ann", small.Bytes()); rec.Code >= 400 {
+		t.Fatalf("small photo: got %d %s", rec.Code, rec.Body)
+	}
+
+	// A tiny PNG whose header claims 30000x30000 pixels
+	huge := append([]byte{}, small.Bytes()...)
+	binary.BigEndian.PutUint32(huge[16:], 30000)
+	binary.BigEndian.PutUint32(huge[20:], 30000)
+	binary.BigEndian.PutUint32(huge[29:], crc32.ChecksumIEEE(huge[12:29]))
+	rec := uploadPhoto(t, "photo", "t-Ben", huge)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "pixels") {
+		t.Errorf("30000x30000 photo: got %d %q, want a 400 about its size", rec.Code, rec.Body)
+	}
+
+	// Just over the limit on one side
+	binary.BigEndian.PutUint32(huge[16:], maxPhotoPixels+1)
+	binary.BigEndian.PutUint32(huge[20:], 10)
+	binary.BigEndian.PutUint32(huge[29:], crc32.ChecksumIEEE(huge[12:29]))
+	if rec := uploadPhoto(t, "photo", "t-Ben", huge); rec.Code != http.StatusBadRequest {
+		t.Errorf("%dx10 photo: got %d, want 400", maxPhotoPixels+1, rec.Code)
+	}
+
+	// Decoding is shed once every slot is busy
+	for i := 0; i < cap(photoSlots); i++ {
+		photoSlots <- struct{}{}
+	}
+	rec = uploadPhoto(t, "photo", "t-Cat", small.Bytes())
+	for i := 0; i < cap(photoSlots); i++ {
+		<-photoSlots
+	}
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("photo with every decode slot taken: got %d, want 503 with Retry-After", rec.Code)
+	}
+	if rec := uploadPhoto(t, "photo", "t-Cat", small.Bytes()); rec.Code >= 400 {
+		t.Errorf("photo once a slot is free: got %d %s", rec.Code, rec.Body)
+	}
+}
+
+// serve sends a request to drawHandler. Form values go in the body of POSTs.
+func serve(t *testing.T, method, path string, form url.Values) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+	if form != nil {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	rec := httptest.NewRecorder()
+	drawHandler(rec, r)
+	return rec
+}
+
+// joinAs joins draw id as name and returns the new participant token
+func joinAs(t *testing.T, id, name string) string {
+	t.Helper()
+	rec := serve(t, "POST", "/draw/"+id+"/join", url.Values{"name": {name}, "wish": {"a book"}})
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("joining as %s: got %d %s", name, rec.Code, rec.Body)
+	}
+	return rec.Header().Get("Location")[strings.LastIndex(rec.Header().Get("Location"), "/")+1:]
+}
+
+func TestApprovalQueue(t *testing.T) {
+	draw := addTestDraw(t, "approval", "Org")
+	expected := 3
+	draw.ExpectedParticipants = &expected
+	draw.ApprovalRequired = true
+	organizer := "?organizer=" + draw.OrganizerToken
+
+	ann, ben, cat := joinAs(t, "approval", "Ann"), joinAs(t, "approval", "Ben"), joinAs(t, "approval", "Cat")
+	dataMutex.RLock()
+	active, pending := len(draw.activeParticipants()), draw.Participants[ann].Pending
+	dataMutex.RUnlock()
+	if active != 1 || draw.participantTotal() != 1 || !pending {
+		t.Fatalf("pending joins count toward capacity: %d active, total %d", active, draw.participantTotal())
+	}
+	if rec := serve(t, "GET", "/draw/approval/roster?token="+ann, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("pending participant reading the roster: got %d, want 404", rec.Code)
+	}
+
+	for _, token := range []string{ann, ben} {
+		if rec := serve(t, "POST", "/draw/approval/approve"+organizer, url.Values{"participant": {token}}); rec.Code != http.StatusSeeOther {
+			t.Fatalf("approve: got %d %s", rec.Code, rec.Body)
+		}
+	}
+	if rec := serve(t, "GET", "/draw/approval/roster?token="+ann, nil); rec.Code != http.StatusOK {
+		t.Errorf("approved participant reading the roster: got %d, want 200", rec.Code)
+	}
+	if rec := serve(t, "POST", "/draw/approval/approve"+organizer, url.Values{"participant": {cat}}); rec.Code != http.StatusConflict {
+		t.Errorf("approving beyond capacity: got %d, want 409", rec.Code)
+	}
+	if rec := serve(t, "POST", "/draw/approval/reject"+organizer, url.Values{"participant": {cat}}); rec.Code != http.StatusSeeOther {
+		t.Fatalf("reject: got %d %s", rec.Code, rec.Body)
+	}
+
+	dataMutex.RLock()
+	defer dataMutex.RUnlock()
+	if _, ok := draw.Participants[cat]; ok {
+		t.Errorf("rejected join is still there")
+	}
+	if p := draw.Participants[ben]; p.Pending || !p.Submitted {
+		t.Errorf("approved join: pending %v, submitted %v", p.Pending, p.Submitted)
+	}
+	if n := len(draw.activeParticipants()); n != 3 || draw.participantTotal() != 3 {
+		t.Errorf("after approving two: %d active, total %d, want 3", n, draw.participantTotal())
+	}
+}
+
+func TestPendingJoinsAreCapped(t *testing.T) {
+	draw := addTestDraw(t, "pendingcap", "Org")
+	expected := 3
+	draw.ExpectedParticipants = &expected
+	draw.ApprovalRequired = true
+
+	for i := 1; i < maxParticipants; i++ {
+		joinAs(t, "pendingcap", fmt.Sprintf("Guest %d", i))
+	}
+	rec := serve(t, "POST", "/draw/pendingcap/join", url.Values{"name": {"One too many"}})
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("join beyond %d rows: got %d, want 403", maxParticipants, rec.Code)
+	}
+}
+
+func TestCodenamesStayUniqueAfterReject(t *testing.T) {
+	draw := addTestDraw(t, "codenames", "Org", "Ann", "Ben")
+	draw.ApprovalRequired = true
+	expected := 10
+	draw.ExpectedParticipants = &expected
+	organizer := "?organizer=" + draw.OrganizerToken
+	if rec := serve(t, "POST", "/draw/codenames/participants/shuffle-names"+organizer, url.Values{}); rec.Code >= 400 {
+		t.Fatalf("shuffle-names: got %d %s", rec.Code, rec.Body)
+	}
+
+	cat := joinAs(t, "codenames", "Cat")
+	joinAs(t, "codenames", "Dan")
+	serve(t, "POST", "/draw/codenames/reject"+organizer, url.Values{"participant": {cat}})
+	joinAs(t, "codenames", "Eve")
+
+	dataMutex.RLock()
+	defer dataMutex.RUnlock()
+	seen := make(map[string]bool)
+	for _, p := range draw.Participants {
+		if seen[p.Name] {
+			t.Errorf("codename %q handed out twice", p.Name)
+		}
+		seen[p.Name] = true
+	}
+}
+
+func TestOptOutRowsAreCapped(t *testing.T) {
+	draw := addTestDraw(t, "optoutcap", "Org", "Ann")
+	expected := 3
+	draw.ExpectedParticipants = &expected
+
+	for i := 0; i < maxParticipantRows; i++ {
+		rec := serve(t, "POST", "/draw/optoutcap/join", url.Values{"name": {fmt.Sprintf("Guest %d", i)}})
+		if rec.Code != http.StatusSeeOther {
+			break
+		}
+		token := rec.Header().Get("Location")[strings.LastIndex(rec.Header().Get("Location"), "/")+1:]
+		if rec := serve(t, "POST", "/draw/optoutcap/participants/"+token+"/opt-out", url.Values{}); rec.Code != http.StatusSeeOther {
+			t.Fatalf("opt-out: got %d %s", rec.Code, rec.Body)
+		}
+	}
+
+	dataMutex.RLock()
+	rows := len(draw.Participants)
+	dataMutex.RUnlock()
+	if rows > maxParticipantRows {
+		t.Errorf("join and opt-out loop left %d rows, want at most %d", rows, maxParticipantRows)
+	}
+	if rec := serve(t, "POST", "/draw/optoutcap/join", url.Values{"name": {"Late"}}); rec.Code != http.StatusForbidden {
+		t.Errorf("join at the row cap: got %d, want 403", rec.Code)
+	}
+}
+
+func TestEnvLimitAcceptsZero(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int
+	}{
+		{"", 10},
+		{"0", 0},
+		{"25", 25},
+		{"-1", 10},
+		{"many", 10},
+	}
+	for _, tt := range tests {
+		t.Setenv("TEST_LIMIT", tt.value)
+		if got := envLimit("TEST_LIMIT", 10); got != tt.want {
+			t.Errorf("envLimit with %q = %d, want %d", tt.value, got, tt.want)
+		}
+	}
+
+	// A limiter built from 0 lets everything through
+	t.Setenv("CREATE_RATE_LIMIT", "0")
+	limiter := ratelimit.New(envLimit("CREATE_RATE_LIMIT", 10), time.Minute)
+	for i := 0; i < 50; i++ {
+		if !limiter.Allow("203.0.113.5") {
+			t.Fatalf("CREATE_RATE_LIMIT=0 still limited request %d", i+1)
+		}
+	}
+}
+
+// openStream opens the live-update stream of draw id on srv, from ip when set
+func openStream(t *testing.T, srv *httptest.Server, id, ip string) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest("GET", srv.URL+"/draw/"+id+"/events", nil)
+	if ip != "" {
+		req.Header.Set("X-Forwarded-For", ip)
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestEventsStreamJoin(t *testing.T) {
+	draw := addTestDraw(t, "stream", "Org", "Ann")
+	expected := 5
+	draw.ExpectedParticipants = &expected
+	srv := httptest.NewServer(http.HandlerFunc(drawHandler))
+	t.Cleanup(srv.Close)
+
+	resp := openStream(t, srv, "stream", "")
+	lines := bufio.NewScanner(resp.Body)
+	next := func() drawUpdate {
+		t.Helper()
+		for lines.Scan() {
+			if data, ok := strings.CutPrefix(lines.Text(), "data: "); ok {
+				var u drawUpdate
+				if err := json.Unmarshal([]byte(data), &u); err != nil {
+					t.Fatalf("event %q: %v", data, err)
+				}
+				return u
+			}
+		}
+		t.Fatalf("stream ended: %v", lines.Err())
+		return drawUpdate{}
+	}
+
+	if u := next(); u.Participants != 2 {
+		t.Fatalf("first event: %d participants, want 2", u.Participants)
+	}
+	joinAs(t, "stream", "Ben")
+	if u := next(); u.Participants != 3 || u.Submitted != 3 {
+		t.Errorf("event after a join: %+v, want 3 participants and 3 submitted", u)
+	}
+}
+
+func TestEventsStreamCaps(t *testing.T) {
+	saved := trustedProxies
+	trustedProxies = parseTrustedProxies("127.0.0.1,::1")
+	defer func() { trustedProxies = saved }()
+	addTestDraw(t, "streamcap", "Org", "Ann")
+	addTestDraw(t, "streamcap2", "Org", "Ann")
+	srv := httptest.NewServer(http.HandlerFunc(drawHandler))
+	t.Cleanup(srv.Close)
+
+	for i := 0; i < maxStreamsPerIP; i++ {
+		if resp := openStream(t, srv, "streamcap2", "198.51.100.1"); resp.StatusCode != http.StatusOK {
+			t.Fatalf("stream %d from one IP: got %d", i+1, resp.StatusCode)
+		}
+	}
+	if resp := openStream(t, srv, "streamcap2", "198.51.100.1"); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("stream beyond the per-IP cap: got %d, want 503", resp.StatusCode)
+	}
+
+	for i := 0; i < maxStreamsPerDraw; i++ {
+		if resp := openStream(t, srv, "streamcap", fmt.Sprintf("203.0.113.%d", i+1)); resp.StatusCode != http.StatusOK {
+			t.Fatalf("stream %d to one draw: got %d", i+1, resp.StatusCode)
+		}
+	}
+	resp := openStream(t, srv, "streamcap", "192.0.2.1")
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("stream beyond the per-draw cap: got %d, want 503 with Retry-After", resp.StatusCode)
+	}
+}
+
+func TestUnlimitedRequest(t *testing.T) {
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/healthz", true},
+		{"/draw/abc123/events", true},
+		{"/healthz/detailed", false},
+		{"/admin/events", false},
+		{"/draw/abc123/participant/events", false},
+		{"/draw//events", false},
+		{"/draw/abc123/manage", false},
+	}
+	for _, tt := range tests {
+		if got := unlimitedRequest(httptest.NewRequest("GET", tt.path, nil)); got != tt.want {
+			t.Errorf("unlimitedRequest(%s) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+// holdRequests starts n requests to h from remoteAddr and waits until each one
+// is being served. They stay in flight until the slowHandler's release closes.
+func holdRequests(t *testing.T, h http.Handler, n int, remoteAddr string) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		started := make(chan struct{})
+		go func() {
+			r := httptest.NewRequest("GET", "/slow", nil)
+			r.RemoteAddr = remoteAddr
+			r = r.WithContext(context.WithValue(r.Context(), startedKey{}, started))
+			h.ServeHTTP(httptest.NewRecorder(), r)
+		}()
+		select {
+		case <-started:
+		case <-time.After(time.Second):
+			t.Fatalf("request %d never started", i+1)
+		}
+	}
+}
+
+// startedKey carries the channel a slowHandler request closes once it runs
+type startedKey struct{}
+
+// slowHandler blocks requests to /slow until release is closed, anything else
+// answers straight away
+func slowHandler(release chan struct{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/slow" {
+			return
+		}
+		if started, ok := r.Context().Value(startedKey{}).(chan struct{}); ok {
+			close(started)
+		}
+		<-release
+	})
+}
+
+func TestConcurrencyLimitsShedExcess(t *testing.T) {
+	t.Run("per IP", func(t *testing.T) {
+		release := make(chan struct{})
+		defer close(release)
+		h := limitConcurrencyPerIP(slowHandler(release), 2)
+		holdRequests(t, h, 2, "203.0.113.5:1000")
+
+		r := httptest.NewRequest("GET", "/slow", nil)
+		r.RemoteAddr = "203.0.113.5:1001"
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+			t.Errorf("3rd request from one IP: got %d, want 503 with Retry-After", rec.Code)
+		}
+
+		done := make(chan struct{})
+		r = httptest.NewRequest("GET", "/slow", nil)
+		r.RemoteAddr = "198.51.100.9:1000"
+		r = r.WithContext(context.WithValue(r.Context(), startedKey{}, done))
+		go h.ServeHTTP(httptest.NewRecorder(), r)
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Errorf("another IP was held back by the per-IP limit")
+		}
+	})
+
+	t.Run("global", func(t *testing.T) {
+		saved := concurrencyWait
+		concurrencyWait = 50 * time.Millisecond
+		defer func() { concurrencyWait = saved }()
+		release := make(chan struct{})
+		defer close(release)
+		h := limitConcurrency(slowHandler(release), 3)
+		holdRequests(t, h, 3, "203.0.113.5:1000")
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/slow", nil))
+		if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+			t.Errorf("request beyond the global limit: got %d, want 503 with Retry-After", rec.Code)
+		}
+		rec = httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+		if rec.Code == http.StatusServiceUnavailable {
+			t.Errorf("/healthz was shed while saturated")
+		}
+	})
+}
+
+func TestDataFileChecksum(t *testing.T) {
+	savedData, savedFile := appData, dataFile
+	dryRunMode = false
+	defer func() { appData, dataFile, dryRunMode = savedData, savedFile, true }()
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	dataFile = filepath.Join(t.TempDir(), "data.json")
+	expected := 2
+	appData = Data{Events: map[string]*Draw{"abc123": {
+		Name:                 "Office <party> & co",
+		ExpectedParticipants: &expected,
+		Participants:         map[string]*Participant{"t-Ann": {Name: "Ann", Submitted: true}},
+		DrawDone:             true,
+		CreatedAt:            timeNow(),
+		ShuffleHistory:       []ShuffleRecord{{AttemptedAt: timeNow(), Succeeded: true}},
+	}}}
+	saveDataUnsafe()
+	raw, err := os.ReadFile(dataFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, _ := json.MarshalIndent(appData, "", "  "); !bytes.Equal(raw, want) {
+		t.Errorf("data file layout changed:\n%s\nwant:\n%s", raw, want)
+	}
+
+	// The draw has no drawnAt, prepareDraws fills it in after the check
+	appData = Data{}
+	loadData()
+	if strings.Contains(logs.String(), "mismatch") {
+		t.Errorf("unmodified file reported as modified: %s", logs.String())
+	}
+	if draw := appData.Events["abc123"]; draw == nil || draw.DrawnAt == nil {
+		t.Errorf("DrawnAt was not migrated from the shuffle history")
+	}
+
+	logs.Reset()
+	tampered := bytes.Replace(raw, []byte(`"Ann"`), []byte(`"Bob"`), 1)
+	if err := os.WriteFile(dataFile, tampered, 0644); err != nil {
+		t.Fatal(err)
+	}
+	appData = Data{}
+	loadData()
+	if !strings.Contains(logs.String(), "checksum mismatch") {
+		t.Errorf("edited file not reported, logs: %s", logs.String())
+	}
+}
+
+func TestAssignGiftsSearchesPastReshuffles(t *testing.T) {
+	names := make([]string, 12)
+	for i := range names {
+		names[i] = fmt.Sprintf("P%02d", i)
+	}
+	// avoidAllBut has each participant avoid everyone except allowed(i)
+	avoidAllBut := func(draw *Draw, allowed func(i int) []int) {
+		for i, name := range names {
+			keep := map[string]bool{name: true}
+			for _, j := range allowed(i) {
+				keep[names[j]] = true
+			}
+			draw.Participants["t-"+name].Avoid = nil
+			for _, other := range names {
+				if !keep[other] {
+					draw.Participants["t-"+name].Avoid = append(draw.Participants["t-"+name].Avoid, other)
+				}
+			}
+		}
+	}
+	draw := addTestDraw(t, "search", names...)
+
+	// A single valid cycle among 11! is out of reach of the reshuffles
+	avoidAllBut(draw, func(i int) []int { return []int{(i + 1) % len(names)} })
+	assignment, err := assignGifts(draw, 42)
+	if err != nil {
+		t.Fatalf("assignGifts() error = %v, want the only valid cycle", err)
+	}
+	for i, name := range names {
+		if want := names[(i+1)%len(names)]; assignment["t-"+name] != want {
+			t.Errorf("%s gives to %s, want %s", name, assignment["t-"+name], want)
+		}
+	}
+
+	// Nobody may give to P00
+	avoidAllBut(draw, func(i int) []int { return []int{(i+1)%(len(names)-1) + 1} })
+	if _, err := assignGifts(draw, 42); err != errInfeasibleExclusions {
+		t.Errorf("nobody can give to P00: error = %v, want errInfeasibleExclusions", err)
+	}
+
+	// Two groups that only give among themselves can't form one cycle
+	avoidAllBut(draw, func(i int) []int {
+		half := len(names) / 2
+		return []int{i/half*half + (i+1)%half, i/half*half + (i+2)%half}
+	})
+	if _, err := assignGifts(draw, 42); err != errInfeasibleExclusions {
+		t.Errorf("two closed groups: error = %v, want errInfeasibleExclusions", err)
+	}
+}
+
+func TestDrawsBeyondTheLimitAreShed(t *testing.T) {
+	draw := addTestDraw(t, "shed", "Ann", "Bob", "Cat")
+	for i := 0; i < cap(drawSlots); i++ {
+		drawSlots <- struct{}{}
+	}
+	rec := serve(t, "POST", "/draw/shed/draw", nil)
+	for i := 0; i < cap(drawSlots); i++ {
+		releaseDrawSlot()
+	}
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("draw with every slot taken: got %d, want 503 with Retry-After", rec.Code)
+	}
+	if draw.DrawDone {
+		t.Fatalf("a shed draw was carried out")
+	}
+
+	if rec := serve(t, "POST", "/draw/shed/draw", nil); rec.Code != http.StatusSeeOther {
+		t.Fatalf("draw with a free slot: got %d: %s", rec.Code, rec.Body)
+	}
+	if !draw.DrawDone || draw.Participants["t-Ann"].GiftFor == "" {
+		t.Errorf("draw was not carried out")
+	}
+}
+
+func TestJoinStoresSupportedLanguage(t *testing.T) {
+	draw := addTestDraw(t, "lang", "Org")
+	expected := 4
+	draw.ExpectedParticipants = &expected
+
+	tests := []struct {
+		query, acceptLanguage, want string
+	}{
+		{"?lang=fr", "", "fr"},
+		{"?lang=xx", "de-DE,de;q=0.9", "de"},
+		{"?lang=%3Cscript%3E", "", "en"},
+	}
+	for i, tt := range tests {
+		name := fmt.Sprintf("Guest%d", i)
+		r := httptest.NewRequest("POST", "/draw/lang/join"+tt.query, strings.NewReader(url.Values{"name": {name}, "wish": {"a book"}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Accept-Language", tt.acceptLanguage)
+		rec := httptest.NewRecorder()
+		drawHandler(rec, r)
+		if rec.Code != http.StatusSeeOther {
+			t.Fatalf("join %s: got %d %s", tt.query, rec.Code, rec.Body)
+		}
+		for _, p := range draw.Participants {
+			if p.Name == name && p.Language != tt.want {
+				t.Errorf("join%s with Accept-Language %q stored %q, want %q", tt.query, tt.acceptLanguage, p.Language, tt.want)
+			}
+		}
+	}
+}
+
+func TestParticipantsCSVEscapesFormulas(t *testing.T) {
+	draw := addTestDraw(t, "csv", "Org", "=HYPERLINK(\"http://evil\")", "+1", "-2", "@SUM(A1)", "Plain")
+	draw.Participants["t-Plain"].Wish = "=cmd|' /C calc'!A0"
+
+	rec := serve(t, "GET", "/draw/csv/participants.csv?organizer="+draw.OrganizerToken, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d %s", rec.Code, rec.Body)
+	}
+	rows, err := csv.NewReader(rec.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wishes := map[string]string{}
+	for _, row := range rows[1:] {
+		for _, cell := range row[:2] {
+			if cell != "" && strings.ContainsRune("=+-@", rune(cell[0])) {
+				t.Errorf("cell %q can run as a formula", cell)
+			}
+		}
+		wishes[row[0]] = row[1]
+	}
+	if got, want := wishes["Plain"], "'=cmd|' /C calc'!A0"; got != want {
+		t.Errorf("wish = %q, want %q", got, want)
+	}
+}
+
+func TestStarIsOnlyShownToTheOrganizer(t *testing.T) {
+	draw := addTestDraw(t, "star", "Org", "Ann", "Bob")
+	organizer := "?organizer=" + draw.OrganizerToken
+
+	if rec := serve(t, "POST", "/draw/star/star", url.Values{"participant": {"t-Bob"}}); rec.Code != http.StatusNotFound {
+		t.Errorf("star without the organizer token: got %d, want 404", rec.Code)
+	}
+	if rec := serve(t, "POST", "/draw/star/star"+organizer, url.Values{"participant": {"t-Bob"}}); rec.Code != http.StatusSeeOther {
+		t.Fatalf("star: got %d %s", rec.Code, rec.Body)
+	}
+	if !draw.Participants["t-Bob"].Starred {
+		t.Fatalf("Bob was not starred")
+	}
+
+	if body := serve(t, "GET", "/draw/star/manage"+organizer, nil).Body.String(); !strings.Contains(body, "participant-tag starred") {
+		t.Errorf("organizer doesn't see the star")
+	}
+	if body := serve(t, "GET", "/draw/star/manage", nil).Body.String(); strings.Contains(body, "starred") {
+		t.Errorf("visitors can tell who the organizer starred")
+	}
+}
+
+func TestAdminReassignByToken(t *testing.T) {
+	t.Setenv("ADMIN_PASSWORD", "secret")
+	draw := addTestDraw(t, "reassign", "Org", "Sam")
+	draw.Participants["t-Sam2"] = &Participant{Name: "Sam", Submitted: true}
+	draw.DrawDone = true
+
+	reassign := func(changes string) int {
+		r := httptest.NewRequest("POST", "/admin/draws/reassign/reassign", strings.NewReader(changes))
+		r.SetBasicAuth("admin", "secret")
+		rec := httptest.NewRecorder()
+		adminHandler(rec, r)
+		return rec.Code
+	}
+
+	// Both Sams give to someone named Sam, only tokens tell them apart
+	if code := reassign(`[{"giverToken":"t-Org","receiverToken":"t-Sam"},{"giverToken":"t-Sam","receiverToken":"t-Sam2"},{"giverToken":"t-Sam2","receiverToken":"t-Org"}]`); code != http.StatusNoContent {
+		t.Fatalf("reassign: got %d, want 204", code)
+	}
+	if got := draw.Participants["t-Sam"].GiftFor; got != "Sam" {
+		t.Errorf("t-Sam gives to %q, want Sam", got)
+	}
+	if got := draw.Participants["t-Sam2"].GiftFor; got != "Org" {
+		t.Errorf("t-Sam2 gives to %q, want Org", got)
+	}
+
+	if code := reassign(`[{"giverToken":"t-Org","receiverToken":"t-Sam"},{"giverToken":"t-Sam","receiverToken":"t-Org"},{"giverToken":"t-Sam2","receiverToken":"t-Sam2"}]`); code != http.StatusBadRequest {
+		t.Errorf("self-gift: got %d, want 400", code)
+	}
+	if code := reassign(`[{"giverToken":"t-Org","receiverToken":"t-Sam"},{"giverToken":"t-Sam","receiverToken":"t-Sam"},{"giverToken":"t-Sam2","receiverToken":"t-Org"}]`); code != http.StatusBadRequest {
+		t.Errorf("receiver twice: got %d, want 400", code)
+	}
+}
+
+func TestNameCheck(t *testing.T) {
+	draw := addTestDraw(t, "names", "Johnathan", "Al", "Maria")
+	draw.NameSimilarityCheck = true
+
+	tests := []struct {
+		name               string
+		available, similar bool
+	}{
+		{"Jonathan", true, true}, // one letter missing
+		{"Jonathon", true, true}, // two edits
+		{"Jonatan", true, true},  // two letters missing
+		{"Jon", true, false},     // too far
+		{"Bo", true, false},      // short names differ entirely
+		{"Ali", true, true},      // one letter added to a short name
+		{"Marie", true, true},    // one letter changed
+		{"MARIA", false, false},  // exact match, whatever the case
+		{" johnathan ", false, false},
+		{"Peter", true, false},
+	}
+	for _, tt := range tests {
+		rec := serve(t, "GET", "/draw/names/name-check?name="+url.QueryEscape(tt.name), nil)
+		var got struct {
+			Available bool `json:"available"`
+			Similar   bool `json:"similar"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			t.Fatalf("name-check %q: %v: %s", tt.name, err, rec.Body)
+		}
+		if got.Available != tt.available || got.Similar != tt.similar {
+			t.Errorf("name-check %q = %+v, want available %v similar %v", tt.name, got, tt.available, tt.similar)
+		}
+		for _, existing := range []string{"Johnathan", "Maria"} {
+			if strings.Contains(rec.Body.String(), existing) {
+				t.Errorf("name-check %q discloses %s: %s", tt.name, existing, rec.Body)
+			}
+		}
+	}
+
+	draw.NameSimilarityCheck = false
+	if body := serve(t, "GET", "/draw/names/name-check?name=Jonathan", nil).Body.String(); strings.Contains(body, `"similar":true`) {
+		t.Errorf("similarity reported with the check off: %s", body)
+	}
+}
+
+func TestReadOnlyModes(t *testing.T) {
+	defer func(saved string) { readOnlyMode = saved }(readOnlyMode)
+	t.Setenv("BANNER", "")
+
+	readOnlyMode = "true"
+	if got := loadBanner().Text; got != "read_only_banner" {
+		t.Errorf("READ_ONLY=true banner = %q, want read_only_banner", got)
+	}
+	rec := httptest.NewRecorder()
+	createDrawHandler(rec, httptest.NewRequest("POST", "/draw/create", strings.NewReader("eventname=Office&organizername=Ann")))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("create with READ_ONLY=true: got %d, want 503", rec.Code)
+	}
+	draw := addTestDraw(t, "readonly", "Ann", "Bob", "Cat")
+	if rec := serve(t, "POST", "/draw/readonly/draw", nil); rec.Code != http.StatusSeeOther || !draw.DrawDone {
+		t.Errorf("draw with READ_ONLY=true: got %d %s, want it carried out", rec.Code, rec.Body)
+	}
+
+	readOnlyMode = "all"
+	if got := loadBanner().Text; got != "read_only_all_banner" {
+		t.Errorf("READ_ONLY=all banner = %q, want read_only_all_banner", got)
+	}
+	addTestDraw(t, "frozen", "Ann", "Bob", "Cat")
+	if rec := serve(t, "POST", "/draw/frozen/draw", nil); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("draw with READ_ONLY=all: got %d, want 503", rec.Code)
+	}
+	for _, lang := range supportedLanguages {
+		if text := loadTranslations(lang).primary["read_only_all_banner"]; text == "" {
+			t.Errorf("%s has no read_only_all_banner", lang)
+		}
+	}
+}
+
+func TestHealthChecksSkipStorageInDryRun(t *testing.T) {
+	defer func(saved string) { dataFile = saved }(dataFile)
+	// A real probe fails here, the directory doesn't exist
+	dataFile = filepath.Join(t.TempDir(), "missing", "data.json")
+	t.Setenv("HEALTH_SECRET", "secret")
+
+	rec := httptest.NewRecorder()
+	healthHandler(rec, httptest.NewRequest("GET", "/healthz", nil))
+	var health map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &health); err != nil || rec.Code != http.StatusOK || health["status"] != "ok" || health["dryRun"] != true {
+		t.Errorf("/healthz: got %d %q", rec.Code, rec.Body)
+	}
+
+	rec = httptest.NewRecorder()
+	healthDetailedHandler(rec, httptest.NewRequest("GET", "/healthz/detailed?secret=secret", nil))
+	var details HealthStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &details); err != nil || details.StoreType != "dry-run" || !details.StorageWritable || !details.DryRun {
+		t.Errorf("/healthz/detailed: got %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestDrawAlgorithmDerangement(t *testing.T) {
+	for _, size := range []int{3, 5, 10, 20, 50} {
+		size := size
+		t.Run(fmt.Sprint(size), func(t *testing.T) {
+			t.Parallel()
+			draw := &Draw{Participants: make(map[string]*Participant)}
+			tokenOf := make(map[string]string)
+			for i := 0; i < size; i++ {
+				name := fmt.Sprintf("P%02d", i)
+				draw.Participants["t-"+name] = &Participant{Name: name, Submitted: true}
+				tokenOf[name] = "t-" + name
+			}
+
+			rng := mathrand.New(mathrand.NewSource(int64(size)))
+			for run := 0; run < 1000; run++ {
+				seed := rng.Int63()
+				assignment, err := assignGifts(draw, seed)
+				if err != nil {
+					t.Fatalf("seed %d: %v", seed, err)
+				}
+				if len(assignment) != size {
+					t.Fatalf("seed %d: %d givers, want %d", seed, len(assignment), size)
+				}
+				received := make(map[string]bool, size)
+				for giver, receiver := range assignment {
+					if tokenOf[receiver] == giver {
+						t.Fatalf("seed %d: %s gives to themselves", seed, receiver)
+					}
+					if _, ok := tokenOf[receiver]; !ok || received[receiver] {
+						t.Fatalf("seed %d: %q is unknown or receives twice", seed, receiver)
+					}
+					received[receiver] = true
+				}
+			}
+		})
+	}
+}
+
+func TestMaxParticipantsRaceCondition(t *testing.T) {
+	draw := addTestDraw(t, "race", "Org")
+	expected := 5
+	draw.ExpectedParticipants = &expected
+
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			r := httptest.NewRequest("POST", "/draw/race/join", strings.NewReader(url.Values{"name": {fmt.Sprintf("Guest%d", i)}, "wish": {"a book"}}.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			drawHandler(httptest.NewRecorder(), r)
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	dataMutex.RLock()
+	defer dataMutex.RUnlock()
+	if got := len(draw.Participants); got > expected {
+		t.Errorf("%d participants joined a draw expecting %d", got, expected)
+	}
+	if got := int(draw.participantCount.Load()); got != len(draw.Participants) {
+		t.Errorf("participantCount = %d, want %d", got, len(draw.Participants))
+	}
+}
+
+func TestJoinFullDraw(t *testing.T) {
+	addTestDraw(t, "full", "Ann", "Bob", "Cat")
+
+	join := func(accept, acceptLanguage string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/draw/full/join", strings.NewReader(url.Values{"name": {"Dan"}, "wish": {"a book"}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Accept", accept)
+		r.Header.Set("Accept-Language", acceptLanguage)
+		rec := httptest.NewRecorder()
+		drawHandler(rec, r)
+		return rec
+	}
+
+	rec := join("text/html", "fr-FR,fr;q=0.9")
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("browser join at capacity: got %d, want 403", rec.Code)
+	}
+	if want := loadTranslations("fr").primary["error_event_full"]; !strings.Contains(rec.Body.String(), want) {
+		t.Errorf("browser join at capacity: body %q, want the French message %q", rec.Body, want)
+	}
+
+	rec = join("application/json", "")
+	var got apiError
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("API join at capacity: %v: %s", err, rec.Body)
+	}
+	if rec.Code != http.StatusForbidden || got.Code != "event_full" || got.Message == "" {
+		t.Errorf("API join at capacity: got %d %+v, want 403 event_full", rec.Code, got)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("API join at capacity: Content-Type %q", ct)
+	}
+}
+
+func TestSlowRequestsAreLogged(t *testing.T) {
+	var logs bytes.Buffer
+	// SetDefault also redirects the log package, put both back afterwards
+	defer func(saved *slog.Logger) {
+		slog.SetDefault(saved)
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+	}(slog.Default())
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&logs, nil)))
+
+	slow := logSlowRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("slow") == "yes" {
+			time.Sleep(30 * time.Millisecond)
+		}
+	}), 10*time.Millisecond)
+	id, token := "0123456789abcdef0123456789abcdef", "fedcba9876543210fedcba9876543210"
+	path := "/draw/" + id + "/participant/" + token
+
+	slow.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", path+"?name=Ann", nil))
+	if logs.Len() > 0 {
+		t.Fatalf("fast request logged: %s", logs.String())
+	}
+
+	slow.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", path+"?slow=yes&name=Ann", nil))
+	var entry map[string]string
+	if err := json.Unmarshal(logs.Bytes(), &entry); err != nil {
+		t.Fatalf("slow request not logged: %v %q", err, logs.String())
+	}
+	if entry["level"] != "WARN" || entry["msg"] != "slow request" || entry["method"] != "POST" || entry["route"] != "/draw/{id}/participant/{token}" {
+		t.Errorf("slow request logged as %v", entry)
+	}
+	if duration, err := time.ParseDuration(entry["duration"]); err != nil || duration < 30*time.Millisecond {
+		t.Errorf("duration = %q, want at least 30ms", entry["duration"])
+	}
+	for _, private := range []string{id, token, "Ann"} {
+		if strings.Contains(logs.String(), private) {
+			t.Errorf("log discloses %q: %s", private, logs.String())
+		}
+	}
+}
+
+func TestAdminVerifyReportsAnomalies(t *testing.T) {
+	t.Setenv("ADMIN_PASSWORD", "secret")
+	fixture, err := os.ReadFile("testdata/anomalies.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataMutex.Lock()
+	saved := appData
+	appData = Data{}
+	if err := json.Unmarshal(fixture, &appData); err != nil {
+		t.Fatal(err)
+	}
+	before, _ := json.Marshal(appData)
+	dataMutex.Unlock()
+	defer func() {
+		dataMutex.Lock()
+		appData = saved
+		dataMutex.Unlock()
+	}()
+
+	r := httptest.NewRequest("GET", "/admin/verify", nil)
+	r.SetBasicAuth("admin", "secret")
+	rec := httptest.NewRecorder()
+	adminHandler(rec, r)
+	var report struct {
+		Draws     int       `json:"draws"`
+		Anomalies []Anomaly `json:"anomalies"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatalf("got %d %s", rec.Code, rec.Body)
+	}
+
+	want := []Anomaly{
+		{"dup-name", "Ann", "name used by 2 participants"},
+		{"no-created", "", "missing creation date"},
+		{"no-expected", "", "missing expected participant count"},
+		{"no-recipient", "Ann", "receives 0 gifts"},
+		{"no-recipient", "Cat", "draw done but no recipient assigned"},
+		{"over-expected", "", "2 participants but only 1 expected"},
+		{"self", "Ann", "assigned to themselves"},
+		{"self", "Ann", "receives 0 gifts"},
+		{"too-few", "", "draw done with only 2 participants"},
+		{"twice", "Ann", "receives 0 gifts"},
+		{"twice", "Bob", "receives 2 gifts"},
+		{"unknown", "Ann", "assigned to an unknown participant"},
+		{"unknown", "Ann", "receives 0 gifts"},
+		{"unsubmitted", "Cat", "not submitted in a done draw"},
+	}
+	got := report.Anomalies
+	sort.Slice(got, func(i, j int) bool { return fmt.Sprint(got[i]) < fmt.Sprint(got[j]) })
+	if report.Draws != 11 || fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("verify reported %d draws:\n%v\nwant 11 draws:\n%v", report.Draws, got, want)
+	}
+
+	dataMutex.RLock()
+	after, _ := json.Marshal(appData)
+	dataMutex.RUnlock()
+	if !bytes.Equal(before, after) {
+		t.Errorf("verify modified the data")
+	}
+}
+
+func TestWishMarkupIsStripped(t *testing.T) {
+	defer func(saved bool) { stripWishHTML = saved }(stripWishHTML)
+
+	stripWishHTML = false
+	if got := normalizeWish("<b>socks</b>"); got != "<b>socks</b>" {
+		t.Errorf("STRIP_WISH_HTML off: normalizeWish changed the wish to %q", got)
+	}
+
+	stripWishHTML = true
+	tests := []struct{ wish, want string }{
+		{"<b>socks</b>", "socks"},
+		{"  <i>warm</i> <u>socks</u> ", "warm socks"},
+		{`<a href="https://example.com">a book</a>`, "a book"},
+		{"socks &amp; gloves", "socks & gloves"},
+		{"1 < 2 socks", "1 < 2 socks"},
+		{"plain socks", "plain socks"},
+	}
+	for _, tt := range tests {
+		if got := normalizeWish(tt.wish); got != tt.want {
+			t.Errorf("normalizeWish(%q) = %q, want %q", tt.wish, got, tt.want)
+		}
+	}
+
+	draw := addTestDraw(t, "markup", "Org")
+	expected := 2
+	draw.ExpectedParticipants = &expected
+	rec := serve(t, "POST", "/draw/markup/join", url.Values{"name": {"Ann"}, "wish": {"<b>socks</b>"}})
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("join: got %d %s", rec.Code, rec.Body)
+	}
+	for _, p := range draw.Participants {
+		if p.Name == "Ann" && p.Wish != "socks" {
+			t.Errorf("stored wish = %q, want socks", p.Wish)
+		}
+	}
+}
+
+func TestTTL(t *testing.T) {
+	now := time.Date(2024, 12, 10, 12, 0, 0, 0, time.UTC)
+	defer func(saved func() time.Time) { timeNow = saved }(timeNow)
+	timeNow = func() time.Time { return now }
+	defer func(days, done int) { retentionDays, doneRetentionDays = days, done }(retentionDays, doneRetentionDays)
+	retentionDays, doneRetentionDays = 30, 90
+
+	draw := addTestDraw(t, "ttl", "Ann", "Bob", "Cat")
+	draw.CreatedAt = now.AddDate(0, 0, -10)
+
+	ttl := func() (got struct {
+		CreatedAt        time.Time `json:"createdAt"`
+		RetentionDays    int       `json:"retentionDays"`
+		DeleteAt         time.Time `json:"deleteAt"`
+		SecondsRemaining int64     `json:"secondsRemaining"`
+	}) {
+		t.Helper()
+		rec := serve(t, "GET", "/draw/ttl/ttl", nil)
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			t.Fatalf("got %d %s", rec.Code, rec.Body)
+		}
+		return got
+	}
+
+	got := ttl()
+	if want := draw.CreatedAt.AddDate(0, 0, 30); !got.DeleteAt.Equal(want) || got.RetentionDays != 30 {
+		t.Errorf("deleteAt = %v (%d days), want createdAt + 30 days = %v", got.DeleteAt, got.RetentionDays, want)
+	}
+	if want := int64(20 * 24 * 60 * 60); got.SecondsRemaining != want {
+		t.Errorf("secondsRemaining = %d, want %d", got.SecondsRemaining, want)
+	}
+
+	draw.DrawDone = true
+	if got := ttl(); !got.DeleteAt.Equal(draw.CreatedAt.AddDate(0, 0, 90)) || got.RetentionDays != 90 {
+		t.Errorf("done draw: deleteAt = %v (%d days), want createdAt + 90 days", got.DeleteAt, got.RetentionDays)
+	}
+
+	draw.CreatedAt = now.AddDate(0, 0, -100)
+	if got := ttl(); got.SecondsRemaining != 0 {
+		t.Errorf("expired draw: secondsRemaining = %d, want 0", got.SecondsRemaining)
+	}
+
+	if rec := serve(t, "GET", "/draw/unknown/ttl", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown draw: got %d, want 404", rec.Code)
+	}
+}
+
+func TestSurpriseReveal(t *testing.T) {
+	draw := addTestDraw(t, "surprise", "Ann", "Bartholomew", "Cat")
+	draw.SurpriseReveal = true
+	draw.DrawDone = true
+	draw.Participants["t-Ann"].GiftFor = "Bartholomew"
+	draw.Participants["t-Bartholomew"].GiftFor = "Cat"
+	draw.Participants["t-Bartholomew"].Wish = "a red scarf"
+	draw.Participants["t-Cat"].GiftFor = "Ann"
+
+	// Step 1: only a link to the reveal, the recipient isn't sent at all
+	rec := serve(t, "GET", "/draw/surprise/participant/t-Ann", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("first step: got %d", rec.Code)
+	}
+	body := rec.Body.String()
+	if !strings.Contains(body, `name="reveal" value="1"`) {
+		t.Errorf("first step has no link to the reveal")
+	}
+	for _, secret := range []string{"Bartholomew", "a red scarf"} {
+		if strings.Contains(body, secret) {
+			t.Errorf("first step discloses %q", secret)
+		}
+	}
+
+	// Step 2: the recipient and their wish are shown
+	body = serve(t, "GET", "/draw/surprise/participant/t-Ann?reveal=1", nil).Body.String()
+	for _, secret := range []string{"Bartholomew", "a red scarf"} {
+		if !strings.Contains(body, secret) {
+			t.Errorf("second step doesn't show %q", secret)
+		}
+	}
+	if strings.Contains(body, `name="reveal" value="1"`) {
+		t.Errorf("second step still asks to reveal")
+	}
+}
+
+func TestCORS(t *testing.T) {
+	defer func(saved map[string]bool) { corsAllowedOrigins = saved }(corsAllowedOrigins)
+	t.Setenv("CORS_ALLOWED_ORIGINS", "https://app.example/, *")
+	corsAllowedOrigins = loadAllowedOrigins()
+	addTestDraw(t, "cors", "Ann", "Bob", "Cat")
+
+	request := func(method, path, origin string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		r.Header.Set("Origin", origin)
+		rec := httptest.NewRecorder()
+		drawHandler(rec, r)
+		return rec
+	}
+
+	tests := []struct {
+		name, method, path, origin string
+		code                       int
+		allowOrigin                string
+	}{
+		{"allowed", "GET", "/draw/cors/status", "https://app.example", http.StatusOK, "https://app.example"},
+		{"disallowed", "GET", "/draw/cors/status", "https://evil.example", http.StatusOK, ""},
+		{"wildcard is ignored", "GET", "/draw/cors/status", "https://other.example", http.StatusOK, ""},
+		{"preflight allowed", "OPTIONS", "/draw/cors/status", "https://app.example", http.StatusNoContent, "https://app.example"},
+		{"preflight disallowed", "OPTIONS", "/draw/cors/status", "https://evil.example", http.StatusForbidden, ""},
+		{"HTML page", "GET", "/draw/cors/manage", "https://app.example", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		rec := request(tt.method, tt.path, tt.origin)
+		if rec.Code != tt.code || rec.Header().Get("Access-Control-Allow-Origin") != tt.allowOrigin {
+			t.Errorf("%s: got %d with Access-Control-Allow-Origin %q, want %d with %q",
+				tt.name, rec.Code, rec.Header().Get("Access-Control-Allow-Origin"), tt.code, tt.allowOrigin)
+		}
+		if rec.Header().Get("Access-Control-Allow-Credentials") != "" {
+			t.Errorf("%s: credentials allowed", tt.name)
+		}
+	}
+
+	rec := request("OPTIONS", "/draw/cors/status", "https://app.example")
+	if methods := rec.Header().Get("Access-Control-Allow-Methods"); !strings.Contains(methods, "GET") {
+		t.Errorf("preflight allows methods %q, want GET", methods)
+	}
+	if vary := rec.Header().Get("Vary"); vary != "Origin" {
+		t.Errorf("Vary = %q, want Origin", vary)
+	}
+}
+
+func TestMinWaitBeforeDraw(t *testing.T) {
+	now := time.Date(2024, 12, 1, 9, 0, 0, 0, time.UTC)
+	defer func(saved func() time.Time) { timeNow = saved }(timeNow)
+	timeNow = func() time.Time { return now }
+	defer func(saved time.Duration) { minWaitBeforeDraw = saved }(minWaitBeforeDraw)
+	minWaitBeforeDraw = time.Hour
+
+	draw := addTestDraw(t, "wait", "Ann", "Bob", "Cat")
+	draw.CreatedAt = now.Add(-59 * time.Minute)
+	if rec := serve(t, "POST", "/draw/wait/draw", nil); rec.Code != http.StatusConflict || draw.DrawDone {
+		t.Fatalf("draw after 59 minutes: got %d, want 409", rec.Code)
+	}
+
+	now = now.Add(time.Minute)
+	if rec := serve(t, "POST", "/draw/wait/draw", nil); rec.Code != http.StatusSeeOther || !draw.DrawDone {
+		t.Errorf("draw after an hour: got %d %s, want it carried out", rec.Code, rec.Body)
+	}
+}
+
+func TestRenderFailuresServe500(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	tests := []struct {
+		name     string
+		template string
+		data     interface{}
+	}{
+		{"unknown template", "no-such-page.html", nil},
+		{"execution error", "participant.html", 42},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/?lang=fr", nil)
+		rec := httptest.NewRecorder()
+		render(rec, r, tt.template, tt.data)
+		if rec.Code != http.StatusInternalServerError {
+			t.Errorf("%s: got %d, want 500", tt.name, rec.Code)
+		}
+		body := rec.Body.String()
+		if want := loadTranslations("fr").Get("error_page_message"); !strings.Contains(body, html.EscapeString(want)) {
+			t.Errorf("%s: body lacks the French error message:\n%s", tt.name, body)
+		}
+		if strings.Count(body, "<html") != 1 {
+			t.Errorf("%s: partial page sent before the error page:\n%s", tt.name, body)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	homeHandler(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("valid template: got %d", rec.Code)
+	}
+}
+
+func TestNameRules(t *testing.T) {
+	defer func(length int, letter bool) { minNameLength, nameRequireLetter = length, letter }(minNameLength, nameRequireLetter)
+
+	tests := []struct {
+		name          string
+		minLength     int
+		requireLetter bool
+		want          string
+	}{
+		{".", 1, false, ""},
+		{"123", 1, false, ""},
+		{"Al", 2, false, ""},
+		{"A", 2, false, "name_too_short"},
+		{"Zoë", 3, false, ""},
+		{"日本", 3, false, "name_too_short"},
+		{".", 1, true, "name_needs_letter"},
+		{"123", 1, true, "name_needs_letter"},
+		{"-_-", 1, true, "name_needs_letter"},
+		{"R2D2", 1, true, ""},
+		{"Ωmega", 1, true, ""},
+		{"日本", 1, true, ""},
+		{"7", 2, true, "name_too_short"},
+	}
+	for _, tt := range tests {
+		minNameLength, nameRequireLetter = tt.minLength, tt.requireLetter
+		if got := checkNameRules(tt.name); got != tt.want {
+			t.Errorf("checkNameRules(%q) with min %d, letter %v = %q, want %q", tt.name, tt.minLength, tt.requireLetter, got, tt.want)
+		}
+	}
+
+	minNameLength, nameRequireLetter = 2, true
+	draw := addTestDraw(t, "names-rules", "Org")
+	expected := 3
+	draw.ExpectedParticipants = &expected
+	r := httptest.NewRequest("POST", "/draw/names-rules/join", strings.NewReader(url.Values{"name": {"A"}, "wish": {"a book"}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Accept", "application/json")
+	rec := httptest.NewRecorder()
+	drawHandler(rec, r)
+	var got apiError
+	json.Unmarshal(rec.Body.Bytes(), &got)
+	if rec.Code != http.StatusBadRequest || got.Code != "name_too_short" || !strings.Contains(got.Message, "2") {
+		t.Errorf("join as A: got %d %+v, want 400 name_too_short mentioning the minimum", rec.Code, got)
+	}
+
+	r = httptest.NewRequest("POST", "/draw/create", strings.NewReader(url.Values{"eventname": {"..."}, "organizername": {"Ann"}, "expected": {"3"}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Accept", "application/json")
+	rec = httptest.NewRecorder()
+	createDrawHandler(rec, r)
+	json.Unmarshal(rec.Body.Bytes(), &got)
+	if rec.Code != http.StatusBadRequest || got.Code != "name_needs_letter" {
+		t.Errorf("create a draw named ...: got %d %+v, want 400 name_needs_letter", rec.Code, got)
+	}
+}
+
+func TestJoiningShowsInOrganizerList(t *testing.T) {
+	now := time.Date(2024, 12, 1, 9, 30, 0, 0, time.UTC)
+	defer func(saved func() time.Time) { timeNow = saved }(timeNow)
+	timeNow = func() time.Time { return now }
+	draw := addTestDraw(t, "joined", "Org", "Ann")
+	expected := 3
+	draw.ExpectedParticipants = &expected
+
+	list := func() map[string][]string {
+		t.Helper()
+		rec := serve(t, "GET", "/draw/joined/participants.csv?organizer="+draw.OrganizerToken, nil)
+		rows, err := csv.NewReader(rec.Body).ReadAll()
+		if err != nil || len(rows) == 0 {
+			t.Fatalf("participants.csv: %v %d", err, rec.Code)
+		}
+		byName := map[string][]string{}
+		for _, row := range rows[1:] {
+			byName[row[0]] = row
+		}
+		return byName
+	}
+
+	if _, listed := list()["Dan"]; listed {
+		t.Fatalf("Dan listed before joining")
+	}
+	token := joinAs(t, "joined", "Dan")
+	// name, wish, joinedAt, confirmed, viewedAt
+	row, listed := list()["Dan"]
+	if !listed {
+		t.Fatalf("Dan not listed after joining")
+	}
+	if row[2] != "2024-12-01T09:30:00Z" || row[3] != "true" {
+		t.Errorf("Dan listed as %v, want joined at 2024-12-01T09:30:00Z and confirmed", row)
+	}
+	for _, row := range list() {
+		if strings.Contains(strings.Join(row, ","), token) {
+			t.Errorf("participant token listed: %v", row)
+		}
+	}
+}
+
+func TestPerDrawWishLimit(t *testing.T) {
+	create := func(maxWish string) int {
+		form := url.Values{"eventname": {"Office"}, "organizername": {"Ann"}, "expected": {"3"}, "maxwishlength": {maxWish}}
+		r := httptest.NewRequest("POST", "/draw/create", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.RemoteAddr = "198.51.100.7:1234"
+		rec := httptest.NewRecorder()
+		createDrawHandler(rec, r)
+		if rec.Code == http.StatusSeeOther {
+			dataMutex.Lock()
+			for id, draw := range appData.Events {
+				if draw.Name == "Office" {
+					delete(appData.Events, id)
+				}
+			}
+			dataMutex.Unlock()
+		}
+		return rec.Code
+	}
+	for _, maxWish := range []string{"0", "-5", "lots", strconv.Itoa(maxWishCeiling + 1)} {
+		if code := create(maxWish); code != http.StatusBadRequest {
+			t.Errorf("create with max wish length %s: got %d, want 400", maxWish, code)
+		}
+	}
+	if code := create(strconv.Itoa(maxWishCeiling)); code != http.StatusSeeOther {
+		t.Errorf("create with the ceiling as max wish length: got %d, want 303", code)
+	}
+
+	draw := addTestDraw(t, "wishes", "Org")
+	expected := 10
+	draw.ExpectedParticipants = &expected
+	join := func(name, wish string) int {
+		return serve(t, "POST", "/draw/wishes/join", url.Values{"name": {name}, "wish": {wish}}).Code
+	}
+
+	if code := join("Ann", strings.Repeat("a", maxWishLength+1)); code != http.StatusBadRequest {
+		t.Errorf("wish over the global limit: got %d, want 400", code)
+	}
+	limit := maxWishLength * 2
+	draw.MaxWishLength = &limit
+	if code := join("Bob", strings.Repeat("a", limit)); code != http.StatusSeeOther {
+		t.Errorf("wish at the draw's limit: got %d, want 303", code)
+	}
+	if code := join("Cat", strings.Repeat("é", limit)); code != http.StatusSeeOther {
+		t.Errorf("accented wish at the draw's limit: got %d, want 303", code)
+	}
+	if code := join("Dan", strings.Repeat("a", limit+1)); code != http.StatusBadRequest {
+		t.Errorf("wish over the draw's limit: got %d, want 400", code)
+	}
+}
+
+func TestDemoNeverHitsTheStore(t *testing.T) {
+	savedFile := dataFile
+	dryRunMode = false
+	defer func() { dataFile, dryRunMode = savedFile, true }()
+	dataFile = filepath.Join(t.TempDir(), "data.json")
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	addTestDraw(t, "real", "Ann", "Bob", "Cat")
+
+	rec := httptest.NewRecorder()
+	demoHandler(rec, httptest.NewRequest("GET", "/draw/demo", nil))
+	location := rec.Header().Get("Location")
+	id := strings.TrimSuffix(strings.TrimPrefix(location[:strings.Index(location, "?")], "/draw/"), "/manage")
+	defer func() {
+		dataMutex.Lock()
+		delete(demoDraws, id)
+		dataMutex.Unlock()
+	}()
+
+	for _, name := range []string{"Rudolph", "Blitzen"} {
+		joinAs(t, id, name)
+	}
+	if rec := serve(t, "POST", "/draw/"+id+"/draw", nil); rec.Code != http.StatusSeeOther {
+		t.Fatalf("demo draw: got %d %s", rec.Code, rec.Body)
+	}
+	dataMutex.Lock()
+	saveDataUnsafe()
+	_, stored := appData.Events[id]
+	dataMutex.Unlock()
+
+	raw, err := os.ReadFile(dataFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored || bytes.Contains(raw, []byte(id)) || bytes.Contains(raw, []byte("Rudolph")) {
+		t.Errorf("demo draw %s was stored:\n%s", id, raw)
+	}
+	if !bytes.Contains(raw, []byte(`"real"`)) {
+		t.Errorf("real draw missing from the store, the test saved nothing")
+	}
+}
+
+func TestPins(t *testing.T) {
+	draw := addTestDraw(t, "pins", "Ann", "Bob", "Cat", "Dan")
+	organizer := "?organizer=" + draw.OrganizerToken
+	pin := func(giver, receiver string) int {
+		return serve(t, "POST", "/draw/pins/pins"+organizer, url.Values{"giver": {giver}, "receiver": {receiver}}).Code
+	}
+
+	if code := pin("t-Ann", "t-Cat"); code != http.StatusSeeOther {
+		t.Fatalf("pin Ann -> Cat: got %d", code)
+	}
+	conflicts := []struct{ name, giver, receiver string }{
+		{"second giver for Cat", "t-Bob", "t-Cat"},
+		{"self", "t-Dan", "t-Dan"},
+		{"closed loop", "t-Cat", "t-Ann"},
+		{"unknown receiver", "t-Bob", "t-Zed"},
+	}
+	for _, c := range conflicts {
+		if code := pin(c.giver, c.receiver); code != http.StatusConflict {
+			t.Errorf("%s: got %d, want 409", c.name, code)
+		}
+	}
+	if len(draw.Pins) != 1 {
+		t.Fatalf("pins = %v, want only Ann -> Cat", draw.Pins)
+	}
+
+	for seed := int64(0); seed < 200; seed++ {
+		assignment, err := assignGifts(draw, seed)
+		if err != nil {
+			t.Fatalf("seed %d: %v", seed, err)
+		}
+		if assignment["t-Ann"] != "Cat" {
+			t.Fatalf("seed %d: Ann gives to %s despite the pin", seed, assignment["t-Ann"])
+		}
+	}
+	if rec := serve(t, "POST", "/draw/pins/draw", nil); rec.Code != http.StatusSeeOther || draw.Participants["t-Ann"].GiftFor != "Cat" {
+		t.Errorf("draw: got %d, Ann gives to %q, want Cat", rec.Code, draw.Participants["t-Ann"].GiftFor)
+	}
+
+	// A pin against someone's exclusion leaves no valid draw
+	draw = addTestDraw(t, "pins-excluded", "Ann", "Bob", "Cat", "Dan")
+	draw.Pins = map[string]string{"t-Ann": "t-Cat"}
+	draw.Participants["t-Ann"].Avoid = []string{"Cat"}
+	if rec := serve(t, "POST", "/draw/pins-excluded/draw", nil); rec.Code != http.StatusConflict || draw.DrawDone {
+		t.Errorf("draw with a pin against an exclusion: got %d, want 409", rec.Code)
+	}
+}
+
+func TestSelfDeclaredExclusionsAreHonored(t *testing.T) {
+	draw := addTestDraw(t, "avoid", "Org", "Ann", "Bob", "Cat")
+	expected := 6
+	draw.ExpectedParticipants = &expected
+
+	rec := serve(t, "POST", "/draw/avoid/join", url.Values{"name": {"Dan"}, "wish": {"a book"}, "avoid": {"ann, Nobody,BOB"}})
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("join: got %d %s", rec.Code, rec.Body)
+	}
+	dan := rec.Header().Get("Location")[strings.LastIndex(rec.Header().Get("Location"), "/")+1:]
+
+	for seed := int64(0); seed < 200; seed++ {
+		assignment, err := assignGifts(draw, seed)
+		if err != nil {
+			t.Fatalf("seed %d: %v", seed, err)
+		}
+		if receiver := assignment[dan]; receiver == "Ann" || receiver == "Bob" {
+			t.Fatalf("seed %d: Dan draws %s, whom they asked to avoid", seed, receiver)
+		}
+	}
+	if rec := serve(t, "POST", "/draw/avoid/draw", nil); rec.Code != http.StatusSeeOther {
+		t.Fatalf("draw: got %d %s", rec.Code, rec.Body)
+	}
+	if receiver := draw.Participants[dan].GiftFor; receiver != "Cat" && receiver != "Org" {
+		t.Errorf("Dan draws %s, want Cat or Org", receiver)
+	}
+
+	// Avoiding everyone leaves no valid draw, reported as such
+	draw.DrawDone = false
+	joinAs(t, "avoid", "Eve")
+	for _, p := range draw.Participants {
+		if p.Name == "Eve" {
+			p.Avoid = []string{"Org", "Ann", "Bob", "Cat", "Dan"}
+		}
+	}
+	rec = serve(t, "POST", "/draw/avoid/draw", nil)
+	if rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), errInfeasibleExclusions.Error()) {
+		t.Errorf("draw with Eve avoiding everyone: got %d %q, want 409 %q", rec.Code, rec.Body, errInfeasibleExclusions)
+	}
+}
+
+func TestRosterShowsNamesOnly(t *testing.T) {
+	draw := addTestDraw(t, "roster", "Ann", "Bob", "Cat")
+	draw.Participants["t-Bob"].Wish = "a very secret telescope"
+	draw.Participants["t-Cat"].GiftIdeas = []string{"a hidden kite"}
+	addTestDraw(t, "roster-other", "Zed")
+
+	for _, token := range []string{"", "nope", "t-Zed"} {
+		if rec := serve(t, "GET", "/draw/roster/roster?token="+token, nil); rec.Code != http.StatusNotFound {
+			t.Errorf("roster with token %q: got %d, want 404", token, rec.Code)
+		}
+	}
+
+	rec := serve(t, "GET", "/draw/roster/roster?token=t-Ann", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("roster with a valid token: got %d", rec.Code)
+	}
+	body := rec.Body.String()
+	for _, name := range []string{"Ann", "Bob", "Cat"} {
+		if !strings.Contains(body, name) {
+			t.Errorf("roster doesn't list %s", name)
+		}
+	}
+	for _, private := range []string{"a very secret telescope", "a hidden kite", "t-Bob", "t-Cat"} {
+		if strings.Contains(body, private) {
+			t.Errorf("roster discloses %q", private)
+		}
+	}
+}
+
+func TestParticipantsCSVSortOrders(t *testing.T) {
+	draw := addTestDraw(t, "sorted", "Cat", "Ann", "Bob", "Dan")
+	draw.DrawDone = true
+	base := time.Date(2024, 12, 1, 9, 0, 0, 0, time.UTC)
+	// Joined: Dan, Bob, Cat, Ann. Receivers: Ann->Cat, Bob->Dan, Cat->Bob, Dan->Ann
+	for i, name := range []string{"Dan", "Bob", "Cat", "Ann"} {
+		draw.Participants["t-"+name].JoinedAt = base.Add(time.Duration(i) * time.Minute)
+	}
+	for giver, receiver := range map[string]string{"Ann": "Cat", "Bob": "Dan", "Cat": "Bob", "Dan": "Ann"} {
+		draw.Participants["t-"+giver].GiftFor = receiver
+	}
+
+	givers := func(sort string) []string {
+		t.Helper()
+		rec := serve(t, "GET", "/draw/sorted/participants.csv?organizer="+draw.OrganizerToken+sort, nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("sort %q: got %d %s", sort, rec.Code, rec.Body)
+		}
+		rows, _ := csv.NewReader(rec.Body).ReadAll()
+		var names []string
+		for _, row := range rows[1:] {
+			names = append(names, row[0])
+		}
+		return names
+	}
+
+	tests := []struct{ sort, want string }{
+		{"", "Dan Bob Cat Ann"},
+		{"&sort=joined", "Dan Bob Cat Ann"},
+		{"&sort=giver", "Ann Bob Cat Dan"},
+		{"&sort=receiver", "Dan Cat Ann Bob"},
+	}
+	for _, tt := range tests {
+		if got := strings.Join(givers(tt.sort), " "); got != tt.want {
+			t.Errorf("sort %q: %s, want %s", tt.sort, got, tt.want)
+		}
+	}
+
+	draw.Participants["t-Cat"].Starred = true
+	if got := strings.Join(givers("&sort=giver"), " "); got != "Cat Ann Bob Dan" {
+		t.Errorf("starred first: %s, want Cat Ann Bob Dan", got)
+	}
+
+	if rec := serve(t, "GET", "/draw/sorted/participants.csv?organizer="+draw.OrganizerToken+"&sort=wish", nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("unknown sort: got %d, want 400", rec.Code)
+	}
+	if rec := serve(t, "GET", "/draw/sorted/participants.csv?sort=giver", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("without the organizer token: got %d, want 404", rec.Code)
+	}
+}
+
+func TestHealthDetailsReportsStoreAndSave(t *testing.T) {
+	savedFile := dataFile
+	dryRunMode = false
+	defer func() { dataFile, dryRunMode = savedFile, true }()
+	dataFile = filepath.Join(t.TempDir(), "data.json")
+	now := time.Date(2024, 12, 1, 9, 0, 0, 0, time.UTC)
+	defer func(saved func() time.Time) { timeNow = saved }(timeNow)
+	timeNow = func() time.Time { return now }
+	t.Setenv("HEALTH_SECRET", "secret")
+	addTestDraw(t, "details", "Ann")
+
+	saveData()
+	rec := httptest.NewRecorder()
+	healthDetailedHandler(rec, httptest.NewRequest("GET", "/healthz/detailed?secret=secret", nil))
+
+	var details HealthStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &details); err != nil {
+		t.Fatalf("got %d %s", rec.Code, rec.Body)
+	}
+	if details.StoreType != "json-file" || !details.StorageReadable || !details.StorageWritable {
+		t.Errorf("details = %+v, want a readable and writable json-file store", details)
+	}
+	if details.LastSaveAt == nil || !details.LastSaveAt.Equal(now) {
+		t.Errorf("lastSaveAt = %v, want %v", details.LastSaveAt, now)
+	}
+	if details.ActiveDrawCount != len(appData.Events) {
+		t.Errorf("activeDrawCount = %d, want %d", details.ActiveDrawCount, len(appData.Events))
+	}
+	if strings.Contains(rec.Body.String(), "Ann") {
+		t.Errorf("details disclose draw contents: %s", rec.Body)
+	}
+
+	for _, query := range []string{"", "?secret=wrong"} {
+		rec = httptest.NewRecorder()
+		healthDetailedHandler(rec, httptest.NewRequest("GET", "/healthz/detailed"+query, nil))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("with %q: got %d, want 404", query, rec.Code)
+		}
+	}
+}
+
+func TestLoadCorruptDataFile(t *testing.T) {
+	fixture, err := os.ReadFile("testdata/corrupt.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// In the subprocess below: load the file named by the environment and stop
+	if path := os.Getenv("SECRET_SANTA_LOAD_FILE"); path != "" {
+		dataFile, dryRunMode = path, false
+		appData = Data{}
+		loadData()
+		os.Exit(0)
+	}
+
+	t.Run("strict", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "data.json")
+		if err := os.WriteFile(path, fixture, 0644); err != nil {
+			t.Fatal(err)
+		}
+		cmd := exec.Command(os.Args[0], "-test.run=^TestLoadCorruptDataFile$")
+		cmd.Env = append(os.Environ(), "SECRET_SANTA_LOAD_FILE="+path, "STRICT_LOAD=true")
+		out, err := cmd.CombinedOutput()
+		if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.Success() {
+			t.Fatalf("STRICT_LOAD=true started with a corrupt file: %v\n%s", err, out)
+		}
+		if !bytes.Contains(out, []byte("Refusing to start")) {
+			t.Errorf("no explanation logged:\n%s", out)
+		}
+		if left, _ := os.ReadFile(path); !bytes.Equal(left, fixture) {
+			t.Errorf("the corrupt file was changed")
+		}
+	})
+
+	t.Run("lenient", func(t *testing.T) {
+		savedData, savedFile := appData, dataFile
+		dryRunMode = false
+		defer func() { appData, dataFile, dryRunMode = savedData, savedFile, true }()
+		log.SetOutput(io.Discard)
+		defer log.SetOutput(os.Stderr)
+		dir := t.TempDir()
+		dataFile = filepath.Join(dir, "data.json")
+		if err := os.WriteFile(dataFile, fixture, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		appData = Data{}
+		loadData()
+		if appData.Events == nil || len(appData.Events) != 0 {
+			t.Errorf("started with %v, want no draws", appData.Events)
+		}
+		if _, err := os.Stat(dataFile); !os.IsNotExist(err) {
+			t.Errorf("corrupt file left in place, the next save would overwrite it")
+		}
+		moved, _ := filepath.Glob(dataFile + ".corrupt.*")
+		if len(moved) != 1 {
+			t.Fatalf("corrupt file not set aside: %v", moved)
+		}
+		if kept, _ := os.ReadFile(moved[0]); !bytes.Equal(kept, fixture) {
+			t.Errorf("set-aside file differs from the original")
+		}
+	})
+}
+
+func TestRedactingHandler(t *testing.T) {
+	token := "fedcba9876543210fedcba9876543210"
+	r := httptest.NewRequest("GET", "/draw/0123456789abcdef0123456789abcdef/participant/"+token+"?x=1", nil)
+
+	var logs bytes.Buffer
+	logger := slog.New(NewRedactingHandler(slog.NewJSONHandler(&logs, nil)))
+	logger.Info("request "+r.URL.String(), "url", r.URL.String())
+	logger.Info("request", "url", r.URL)
+	logger.With("url", r.URL.String()).Info("request")
+	logger.Info("request", slog.Group("http", "url", r.URL.String(), "status", 200))
+	logger.Info("request", "url", "/draw/ABC/participant/"+token[:31])
+
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("got %d log lines, want 5:\n%s", len(lines), logs.String())
+	}
+	for _, line := range lines[:4] {
+		if strings.Contains(line, token) || !strings.Contains(line, "/participant/[REDACTED]?x=1") {
+			t.Errorf("token not redacted: %s", line)
+		}
+	}
+	if !strings.Contains(lines[1], `"url":"/draw/[REDACTED]/participant/[REDACTED]?x=1"`) {
+		t.Errorf("*url.URL not redacted: %s", lines[1])
+	}
+	if !strings.Contains(lines[3], `"status":200`) {
+		t.Errorf("non-string attribute altered: %s", lines[3])
+	}
+	if !strings.Contains(lines[4], token[:31]) {
+		t.Errorf("short hex string redacted: %s", lines[4])
+	}
+}
+
+func TestLocaleLockedDraw(t *testing.T) {
+	locked := addTestDraw(t, "locked", "Ann", "Ben")
+	locked.Locale = "de"
+	addTestDraw(t, "unlocked", "Ann", "Ben")
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/draw/locked/join", "de"},
+		{"/draw/locked/participant/t-Ben", "de"},
+		{"/draw/locked/manage?organizer=t-Ann", "de"},
+		{"/draw/locked/join?lang=it", "it"},
+		{"/draw/locked/join?lang=xx", "de"},
+		{"/draw/unlocked/join", "fr"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.path, nil)
+		r.Header.Set("Accept-Language", "fr-FR,fr;q=0.9,en;q=0.5")
+		rec := httptest.NewRecorder()
+		drawHandler(rec, r)
+		if rec.Code != http.StatusOK {
+			t.Errorf("GET %s: %d", tt.path, rec.Code)
+			continue
+		}
+		if lang := `<html lang="` + tt.want + `">`; !strings.Contains(rec.Body.String(), lang) {
+			t.Errorf("GET %s not rendered in %s", tt.path, tt.want)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	createDrawHandler(rec, httptest.NewRequest("POST", "/draw/create?eventname=Office+party&organizername=Ann&expected=3&locale=xx", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("unsupported locale accepted: %d", rec.Code)
+	}
+}
+
+func TestDrawnAtIsSetOnDraw(t *testing.T) {
+	now := time.Date(2024, 12, 1, 10, 0, 0, 0, time.UTC)
+	defer func(saved func() time.Time) { timeNow = saved }(timeNow)
+	timeNow = func() time.Time { return now }
+	draw := addTestDraw(t, "drawnat", "Ann", "Bob", "Cat")
+
+	if body := serve(t, "GET", "/draw/drawnat/manage?organizer=t-Ann", nil).Body.String(); strings.Contains(body, "drawn-at") {
+		t.Errorf("manage page shows a draw time before the draw")
+	}
+	if rec := serve(t, "POST", "/draw/drawnat/draw", nil); rec.Code != http.StatusSeeOther {
+		t.Fatalf("draw: got %d: %s", rec.Code, rec.Body)
+	}
+	if draw.DrawnAt == nil || !draw.DrawnAt.Equal(now) {
+		t.Fatalf("DrawnAt = %v, want %v", draw.DrawnAt, now)
+	}
+
+	now = now.Add(2*time.Hour + 5*time.Minute)
+	if body := serve(t, "GET", "/draw/drawnat/manage?organizer=t-Ann&lang=en", nil).Body.String(); !strings.Contains(body, "Drawn 2 hours ago") {
+		t.Errorf("manage page doesn't say when the draw was done")
+	}
+
+	// Draws done before DrawnAt existed take it from their last successful shuffle
+	old := addTestDraw(t, "drawnat-old", "Ann", "Bob")
+	old.DrawDone = true
+	old.ShuffleHistory = []ShuffleRecord{
+		{AttemptedAt: now.Add(-3 * time.Hour), Succeeded: true},
+		{AttemptedAt: now.Add(-2 * time.Hour), Succeeded: true},
+		{AttemptedAt: now.Add(-time.Hour), Succeeded: false},
+	}
+	dataMutex.Lock()
+	prepareDraws()
+	dataMutex.Unlock()
+	if old.DrawnAt == nil || !old.DrawnAt.Equal(now.Add(-2*time.Hour)) {
+		t.Errorf("migrated DrawnAt = %v, want the last successful shuffle", old.DrawnAt)
+	}
+}
+
+func TestTemplatesAreNamedByBaseName(t *testing.T) {
+	entries, err := fs.ReadDir(templateFS, "templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) == 0 {
+		t.Fatal("no templates embedded")
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if templates.Lookup(name) == nil {
+			t.Errorf("template %s is not addressable by its base name", name)
+		}
+		if templates.Lookup("templates/"+name) != nil {
+			t.Errorf("template %s is also registered under its path", name)
+		}
+	}
+}
+
+func TestAdminEventsPaging(t *testing.T) {
+	t.Setenv("ADMIN_PASSWORD", "secret")
+	dataMutex.Lock()
+	saved := appData
+	appData = Data{Events: make(map[string]*Draw)}
+	base := time.Date(2024, 11, 1, 0, 0, 0, 0, time.UTC)
+	// e0 is the newest; e3 and e4 share a creation time
+	for i, offset := range []int{7, 6, 5, 4, 4, 2, 1} {
+		appData.Events[fmt.Sprintf("e%d", i)] = &Draw{
+			Name:           fmt.Sprintf("Draw %d", i),
+			CreatedAt:      base.Add(time.Duration(offset) * time.Hour),
+			OrganizerToken: "organizer-secret",
+			Participants:   map[string]*Participant{"participant-secret": {Name: "Ann"}},
+		}
+	}
+	dataMutex.Unlock()
+	defer func() {
+		dataMutex.Lock()
+		appData = saved
+		dataMutex.Unlock()
+	}()
+
+	list := func(query string) (*httptest.ResponseRecorder, []string) {
+		r := httptest.NewRequest("GET", "/admin/events"+query, nil)
+		r.SetBasicAuth("admin", "secret")
+		rec := httptest.NewRecorder()
+		adminHandler(rec, r)
+		var events []struct {
+			ID string `json:"id"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &events)
+		var ids []string
+		for _, e := range events {
+			ids = append(ids, e.ID)
+		}
+		return rec, ids
+	}
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"", "e0 e1 e2 e3 e4 e5 e6"},
+		{"?limit=3", "e0 e1 e2"},
+		{"?limit=3&offset=3", "e3 e4 e5"},
+		{"?limit=3&offset=6", "e6"},
+		{"?limit=3&offset=7", ""},
+		{"?offset=100", ""},
+		{"?limit=1&offset=4", "e4"},
+		{"?limit=" + strconv.Itoa(maxEventsPage), "e0 e1 e2 e3 e4 e5 e6"},
+	}
+	for _, tt := range tests {
+		rec, ids := list(tt.query)
+		if rec.Code != http.StatusOK {
+			t.Errorf("%q: got %d %s", tt.query, rec.Code, rec.Body)
+			continue
+		}
+		if got := strings.Join(ids, " "); got != tt.want {
+			t.Errorf("%q: got [%s], want [%s]", tt.query, got, tt.want)
+		}
+		if total := rec.Header().Get("X-Total-Count"); total != "7" {
+			t.Errorf("%q: X-Total-Count = %q, want 7", tt.query, total)
+		}
+		if strings.Contains(rec.Body.String(), "secret") || strings.Contains(rec.Body.String(), "Ann") {
+			t.Errorf("%q: listing discloses tokens or names: %s", tt.query, rec.Body)
+		}
+	}
+
+	for _, query := range []string{"?limit=0", "?limit=-1", "?limit=" + strconv.Itoa(maxEventsPage+1), "?limit=ten", "?offset=-1", "?offset=x"} {
+		if rec, _ := list(query); rec.Code != http.StatusBadRequest {
+			t.Errorf("%q: got %d, want 400", query, rec.Code)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	adminHandler(rec, httptest.NewRequest("GET", "/admin/events", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("listing without credentials: got %d, want 401", rec.Code)
+	}
+}
+
+func TestNoNameNeighbors(t *testing.T) {
+	newDraw := func(names ...string) *Draw {
+		draw := &Draw{Participants: make(map[string]*Participant), NoNameNeighbors: true}
+		for _, name := range names {
+			draw.Participants["t-"+name] = &Participant{Name: name, Submitted: true}
+		}
+		return draw
+	}
+
+	// Sorting ignores case: alice, Bob, carol, Dave, eve
+	draw := newDraw("eve", "Bob", "alice", "Dave", "carol")
+	excluded := draw.exclusions()
+	neighbors := map[string][]string{
+		"alice": {"Bob"},
+		"Bob":   {"alice", "carol"},
+		"carol": {"Bob", "Dave"},
+		"Dave":  {"carol", "eve"},
+		"eve":   {"Dave"},
+	}
+	for giver, want := range neighbors {
+		if len(excluded["t-"+giver]) != len(want) {
+			t.Errorf("%s excludes %v, want %v", giver, excluded["t-"+giver], want)
+		}
+		for _, receiver := range want {
+			if !excluded["t-"+giver]["t-"+receiver] {
+				t.Errorf("%s may draw their neighbor %s", giver, receiver)
+			}
+		}
+	}
+
+	for _, names := range [][]string{
+		{"eve", "Bob", "alice", "Dave", "carol"},
+		{"A", "B", "C", "D", "E", "F", "G", "H"},
+	} {
+		draw := newDraw(names...)
+		excluded := draw.exclusions()
+		for seed := int64(0); seed < 200; seed++ {
+			assignment, err := assignGifts(draw, seed)
+			if err != nil {
+				t.Fatalf("%d people, seed %d: %v", len(names), seed, err)
+			}
+			for giver, receiver := range assignment {
+				if excluded[giver]["t-"+receiver] {
+					t.Fatalf("%d people, seed %d: %s draws their neighbor %s", len(names), seed, giver, receiver)
+				}
+			}
+		}
+	}
+
+	// Too few people for a cycle without neighbors
+	for _, names := range [][]string{{"A", "B"}, {"A", "B", "C"}, {"A", "B", "C", "D"}} {
+		if _, err := assignGifts(newDraw(names...), 1); err != errInfeasibleExclusions {
+			t.Errorf("%d people: got %v, want errInfeasibleExclusions", len(names), err)
+		}
+	}
+
+	// Off by default: three people always draw a neighbor
+	draw = newDraw("A", "B", "C")
+	draw.NoNameNeighbors = false
+	if len(draw.exclusions()) != 0 {
+		t.Errorf("exclusions without the option: %v", draw.exclusions())
+	}
+	if _, err := assignGifts(draw, 1); err != nil {
+		t.Errorf("draw without the option: %v", err)
+	}
+}
+
+func TestStatusNeverDisclosesTokens(t *testing.T) {
+	draw := addTestDraw(t, "status", "Ann", "Bob", "Cat")
+	draw.Participants["t-Cat"].Submitted = false
+	draw.Participants["t-Bob"].Wish = "a very particular teapot"
+	if rec := serve(t, "POST", "/draw/status/draw", nil); rec.Code != http.StatusSeeOther {
+		t.Fatalf("draw: got %d: %s", rec.Code, rec.Body)
+	}
+
+	status := func() (string, []map[string]interface{}) {
+		body := serve(t, "GET", "/draw/status/status", nil).Body.String()
+		var resp struct {
+			People []map[string]interface{} `json:"people"`
+		}
+		if err := json.Unmarshal([]byte(body), &resp); err != nil {
+			t.Fatalf("status: %v %s", err, body)
+		}
+		return body, resp.People
+	}
+
+	body, people := status()
+	for token, p := range draw.Participants {
+		for _, private := range []string{token, p.Wish, p.GiftFor, draw.OrganizerToken} {
+			if strings.Contains(body, private) {
+				t.Errorf("status discloses %q: %s", private, body)
+			}
+		}
+	}
+	if strings.Contains(body, "Ann") {
+		t.Errorf("status shows names the organizer didn't make public: %s", body)
+	}
+	if len(people) != 3 {
+		t.Fatalf("got %d people, want 3", len(people))
+	}
+	submitted := make(map[string]bool)
+	for _, p := range people {
+		if len(p) != 2 {
+			t.Errorf("unexpected fields: %v", p)
+		}
+		submitted[p["publicId"].(string)] = p["submitted"].(bool)
+	}
+	for token, p := range draw.Participants {
+		if got, ok := submitted[publicID(token)]; !ok || got != p.Submitted {
+			t.Errorf("%s: listed %v submitted=%v, want submitted=%v", p.Name, ok, got, p.Submitted)
+		}
+	}
+
+	// IDs stay the same between polls, names appear once the organizer allows it
+	dataMutex.Lock()
+	draw.PublicNames = true
+	dataMutex.Unlock()
+	body, again := status()
+	for i := range again {
+		if again[i]["publicId"] != people[i]["publicId"] {
+			t.Errorf("public IDs changed between polls")
+		}
+		if again[i]["name"] == nil {
+			t.Errorf("no name with public names: %v", again[i])
+		}
+	}
+	for token := range draw.Participants {
+		if strings.Contains(body, token) {
+			t.Errorf("status with public names discloses %q: %s", token, body)
+		}
+	}
+}
+
+func TestDuplicateWishesAreFlagged(t *testing.T) {
+	draw := addTestDraw(t, "dups", "Ann", "Bob", "Cat", "Dan")
+	draw.Participants["t-Ann"].Wish = "Warm  Socks"
+	draw.Participants["t-Bob"].Wish = " warm socks\n"
+	draw.Participants["t-Cat"].Wish = "warm sock"
+	draw.Participants["t-Dan"].Wish = ""
+
+	dataMutex.RLock()
+	dups := duplicateWishes(draw)
+	dataMutex.RUnlock()
+	if !dups["t-Ann"] || !dups["t-Bob"] || len(dups) != 2 {
+		t.Errorf("duplicates = %v, want Ann and Bob", dups)
+	}
+
+	organizer := "/draw/dups/manage?organizer=t-Ann"
+	if body := serve(t, "GET", organizer, nil).Body.String(); strings.Contains(body, "duplicate-wish") {
+		t.Errorf("duplicates flagged without the option")
+	}
+	draw.FlagDuplicateWishes = true
+	if body := serve(t, "GET", organizer, nil).Body.String(); strings.Count(body, "duplicate-wish") != 2 {
+		t.Errorf("manage page flags %d participants, want 2", strings.Count(body, "duplicate-wish"))
+	}
+	if body := serve(t, "GET", "/draw/dups/manage", nil).Body.String(); strings.Contains(body, "duplicate-wish") {
+		t.Errorf("duplicates shown to someone who isn't the organizer")
+	}
+
+	// Flagging never stops anyone from joining
+	expected := 5
+	draw.ExpectedParticipants = &expected
+	rec := serve(t, "POST", "/draw/dups/join", url.Values{"name": {"Eve"}, "wish": {"WARM SOCKS"}})
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("joining with a duplicate wish: got %d %s", rec.Code, rec.Body)
+	}
+	if body := serve(t, "GET", organizer, nil).Body.String(); strings.Count(body, "duplicate-wish") != 3 {
+		t.Errorf("manage page flags %d participants after Eve joined, want 3", strings.Count(body, "duplicate-wish"))
+	}
+}
+
+func TestLongNamesAreTruncatedWhenRendered(t *testing.T) {
+	defer func(saved int) { nameDisplayLength = saved }(nameDisplayLength)
+	nameDisplayLength = 5
+	draw := addTestDraw(t, "widths", "Zoë", "日本語の名前")
+	draw.Name = "Fête de Noël"
+
+	body := serve(t, "GET", "/draw/widths/manage?organizer=t-Zoë&lang=en", nil).Body.String()
+	for _, want := range []string{
+		`<h1 title="Fête de Noël">Fête…</h1>`,
+		`<span title="日本語の名前">日本語の…</span>`,
+		`<span title="Zoë">Zoë</span>`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("manage page doesn't contain %s", want)
+		}
+	}
+
+	nameDisplayLength = 6
+	body = serve(t, "GET", "/draw/widths/participant/t-日本語の名前", nil).Body.String()
+	if !strings.Contains(body, "日本語の名前</h1>") {
+		t.Errorf("a name exactly nameDisplayLength long was truncated")
+	}
+}
+
+func TestCleanupUsesBothRetentionWindows(t *testing.T) {
+	now := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	defer func(saved func() time.Time) { timeNow = saved }(timeNow)
+	timeNow = func() time.Time { return now }
+	defer func(retention, done int) { retentionDays, doneRetentionDays = retention, done }(retentionDays, doneRetentionDays)
+	dataMutex.Lock()
+	defer func(saved Data) { appData = saved; dataMutex.Unlock() }(appData)
+
+	cleanup := func(retention, done int) string {
+		retentionDays, doneRetentionDays = retention, done
+		appData = Data{Events: make(map[string]*Draw)}
+		for id, draw := range map[string]struct {
+			age  int
+			done bool
+		}{
+			"open-29": {29, false}, "open-31": {31, false},
+			"done-31": {31, true}, "done-89": {89, true}, "done-91": {91, true},
+		} {
+			appData.Events[id] = &Draw{CreatedAt: now.AddDate(0, 0, -draw.age), DrawDone: draw.done}
+		}
+		cleanupOldEvents()
+		var kept []string
+		for id := range appData.Events {
+			kept = append(kept, id)
+		}
+		sort.Strings(kept)
+		return strings.Join(kept, " ")
+	}
+
+	if kept := cleanup(30, 90); kept != "done-31 done-89 open-29" {
+		t.Errorf("30 days, 90 once done: kept %s", kept)
+	}
+	if kept := cleanup(30, 30); kept != "open-29" {
+		t.Errorf("a single 30 day window: kept %s", kept)
+	}
+	// Done draws may also be dropped sooner than open ones
+	if kept := cleanup(30, 10); kept != "open-29" {
+		t.Errorf("30 days, 10 once done: kept %s", kept)
+	}
+}
+
+func TestAdminRestoreReplacesData(t *testing.T) {
+	t.Setenv("ADMIN_PASSWORD", "secret")
+	t.Setenv("BACKUP_ON_WRITE", "true")
+	t.Setenv("BACKUP_DIR", "")
+	savedFile := dataFile
+	dataFile = filepath.Join(t.TempDir(), "data.json")
+	dryRunMode = false
+	defer func() { dataFile, dryRunMode = savedFile, true }()
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	dataMutex.Lock()
+	defer func(saved Data) { dataMutex.Lock(); appData = saved; dataMutex.Unlock() }(appData)
+	defer func(saved func() time.Time) { timeNow = saved }(timeNow)
+	now := time.Date(2024, 12, 1, 9, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+
+	// The first save has nothing to back up, the second backs up the first
+	appData = Data{Events: map[string]*Draw{
+		"good": {Name: "Office party", CreatedAt: now, Participants: map[string]*Participant{"t-Ann": {Name: "Ann", Wish: "socks"}}},
+	}}
+	saveDataUnsafe()
+	now = now.Add(time.Minute)
+	appData.Events["later"] = &Draw{Name: "Mistake", CreatedAt: now, Participants: map[string]*Participant{}}
+	delete(appData.Events, "good")
+	saveDataUnsafe()
+	dataMutex.Unlock()
+
+	restore := func(method, query string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/admin/restore"+query, nil)
+		r.SetBasicAuth("admin", "secret")
+		rec := httptest.NewRecorder()
+		adminHandler(rec, r)
+		return rec
+	}
+
+	var backups []struct {
+		Name string `json:"name"`
+	}
+	rec := restore("GET", "")
+	if err := json.Unmarshal(rec.Body.Bytes(), &backups); err != nil || len(backups) != 1 {
+		t.Fatalf("listing backups: %d %s", rec.Code, rec.Body)
+	}
+	name := backups[0].Name
+
+	if rec := restore("POST", "?backup="+name); rec.Code != http.StatusBadRequest {
+		t.Errorf("restore without confirm=yes: got %d, want 400", rec.Code)
+	}
+	if rec := restore("POST", "?backup=../data.json&confirm=yes"); rec.Code != http.StatusNotFound {
+		t.Errorf("restore of an unknown file: got %d, want 404", rec.Code)
+	}
+	dataMutex.RLock()
+	_, untouched := appData.Events["later"]
+	dataMutex.RUnlock()
+	if !untouched {
+		t.Fatalf("a refused restore changed the data")
+	}
+
+	now = now.Add(time.Minute)
+	if rec := restore("POST", "?backup="+name+"&confirm=yes"); rec.Code != http.StatusOK {
+		t.Fatalf("restore: got %d %s", rec.Code, rec.Body)
+	}
+	dataMutex.RLock()
+	good, later := appData.Events["good"], appData.Events["later"]
+	dataMutex.RUnlock()
+	if good == nil || good.Participants["t-Ann"].Wish != "socks" || later != nil {
+		t.Errorf("restore didn't bring back the backed up draws: %v", appData.Events)
+	}
+	// The restored data is saved, so it survives a restart
+	var onDisk Data
+	if raw, err := os.ReadFile(dataFile); err != nil || json.Unmarshal(raw, &onDisk) != nil || onDisk.Events["good"] == nil || onDisk.Events["later"] != nil {
+		t.Errorf("restored data was not saved: %v", onDisk.Events)
+	}
+
+	// Saving the restored data backed up what it replaced
+	if listed := listBackups(); len(listed) != 2 {
+		t.Errorf("got %d backups after restoring, want 2", len(listed))
+	}
+
+	// A backup edited by hand no longer matches its checksum
+	path := filepath.Join(filepath.Dir(dataFile), name)
+	raw, _ := os.ReadFile(path)
+	os.WriteFile(path, bytes.Replace(raw, []byte("socks"), []byte("gloves"), 1), 0644)
+	if rec := restore("POST", "?backup="+name+"&confirm=yes"); rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("restore of a tampered backup: got %d, want 422", rec.Code)
+	}
+}
+
+func TestOrganizerUnsubmittedUntilTheySubmit(t *testing.T) {
+	create := func(form url.Values) (string, string) {
+		t.Helper()
+		r := httptest.NewRequest("POST", "/draw/create", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.RemoteAddr = "198.51.100.43:1234"
+		rec := httptest.NewRecorder()
+		createDrawHandler(rec, r)
+		location, err := url.Parse(rec.Header().Get("Location"))
+		if rec.Code != http.StatusSeeOther || err != nil {
+			t.Fatalf("create: got %d %s", rec.Code, rec.Body)
+		}
+		id := strings.Split(location.Path, "/")[2]
+		t.Cleanup(func() {
+			dataMutex.Lock()
+			delete(appData.Events, id)
+			dataMutex.Unlock()
+		})
+		return id, location.Query().Get("organizer")
+	}
+	submitted := func(id string) int {
+		var status struct {
+			Submitted int `json:"submitted"`
+		}
+		json.Unmarshal(serve(t, "GET", "/draw/"+id+"/status", nil).Body.Bytes(), &status)
+		return status.Submitted
+	}
+
+	// By default the organizer's wish comes with the draw
+	id, _ := create(url.Values{"eventname": {"Office party"}, "organizername": {"Ann"}, "organizerwish": {"socks"}, "expected": {"3"}})
+	if submitted(id) != 1 {
+		t.Errorf("organizer who gave a wish counts as unsubmitted")
+	}
+
+	id, organizer := create(url.Values{"eventname": {"Family"}, "organizername": {"Ann"}, "organizerwishlater": {"on"}, "expected": {"3"}})
+	if submitted(id) != 0 {
+		t.Errorf("organizer who chose to wish later counts as submitted")
+	}
+	manage := "/draw/" + id + "/manage?organizer=" + organizer
+	if body := serve(t, "GET", manage, nil).Body.String(); !strings.Contains(body, "organizer-submit-notice") {
+		t.Errorf("manage page doesn't remind the organizer to submit")
+	}
+
+	rec := serve(t, "POST", "/draw/"+id+"/participant/"+organizer+"/submit", url.Values{"wish": {"a scarf"}})
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("submit: got %d %s", rec.Code, rec.Body)
+	}
+	if submitted(id) != 1 {
+		t.Errorf("organizer still unsubmitted after submitting")
+	}
+	if body := serve(t, "GET", manage, nil).Body.String(); strings.Contains(body, "organizer-submit-notice") {
+		t.Errorf("manage page still reminds the organizer to submit")
+	}
+}
+
+func TestEventsCarryTheSendTime(t *testing.T) {
+	now := time.Date(2024, 12, 1, 10, 0, 0, 0, time.FixedZone("CET", 3600))
+	defer func(saved func() time.Time) { timeNow = saved }(timeNow)
+	timeNow = func() time.Time { return now }
+	draw := addTestDraw(t, "sse", "Ann", "Bob")
+	expected := 3
+	draw.ExpectedParticipants = &expected
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rec := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		drawHandler(rec, httptest.NewRequest("GET", "/draw/sse/events", nil).WithContext(ctx))
+		close(done)
+	}()
+
+	// waitSent waits until the stream took its pending update
+	waitSent := func() {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+			dataMutex.RLock()
+			pending := len(drawSubscribers["sse"]) == 0
+			for ch := range drawSubscribers["sse"] {
+				pending = len(ch) > 0
+			}
+			dataMutex.RUnlock()
+			if !pending {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("stream didn't send its update")
+			}
+		}
+	}
+	waitSent()
+	dataMutex.Lock()
+	draw.Participants["t-Cat"] = &Participant{Name: "Cat", Submitted: true}
+	notifySubscribers("sse", draw)
+	dataMutex.Unlock()
+	waitSent()
+	cancel()
+	<-done
+
+	if ct := rec.Header().Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	var events []map[string]interface{}
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		if line == "" {
+			continue
+		}
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok {
+			t.Errorf("unexpected line %q", line)
+			continue
+		}
+		var event map[string]interface{}
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			t.Errorf("data is not JSON: %q", data)
+			continue
+		}
+		events = append(events, event)
+	}
+	if len(events) != 2 {
+		t.Fatalf("got %d events, want 2: %q", len(events), rec.Body)
+	}
+	for i, event := range events {
+		sent, _ := event["time"].(string)
+		if at, err := time.Parse(time.RFC3339, sent); err != nil || !at.Equal(now) || sent != "2024-12-01T09:00:00Z" {
+			t.Errorf("event %d: time = %q, want %v in UTC RFC 3339", i, sent, now)
+		}
+	}
+	if events[1]["participants"] != float64(3) {
+		t.Errorf("second event: %v, want 3 participants", events[1])
+	}
+}
+
+func TestGiftBoughtNoteLimitCountsCharacters(t *testing.T) {
+	draw := addTestDraw(t, "bought", "Ann", "Bob", "Cat")
+	draw.DrawDone = true
+	note := func(n int) *httptest.ResponseRecorder {
+		return serve(t, "POST", "/draw/bought/participant/t-Ann/gift-bought", url.Values{"giftbought": {strings.Repeat("é", n)}})
+	}
+	if rec := note(maxGiftBought); rec.Code != http.StatusSeeOther {
+		t.Errorf("%d accented characters: got %d %s", maxGiftBought, rec.Code, rec.Body)
+	}
+	if got := draw.Participants["t-Ann"].GiftBought; utf8.RuneCountInString(got) != maxGiftBought {
+		t.Errorf("stored a %d character note", utf8.RuneCountInString(got))
+	}
+	if rec := note(maxGiftBought + 1); rec.Code != http.StatusBadRequest {
+		t.Errorf("%d characters: got %d, want 400", maxGiftBought+1, rec.Code)
+	}
+}
+
+func TestParseGiftIdeas(t *testing.T) {
+	atLimit := strings.Repeat("本", maxGiftIdeaLen)
+	tests := []struct {
+		raw     string
+		want    []string
+		wantErr bool
+	}{
+		{"", nil, false},
+		{" a scarf \n\n  a book\r\n", []string{"a scarf", "a book"}, false},
+		{atLimit, []string{atLimit}, false},
+		{atLimit + "本", nil, true},
+		{strings.Repeat("idea\n", maxGiftIdeas), strings.Fields(strings.Repeat("idea ", maxGiftIdeas)), false},
+		{strings.Repeat("idea\n", maxGiftIdeas+1), nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseGiftIdeas(tt.raw)
+		if (err != nil) != tt.wantErr || !slices.Equal(got, tt.want) {
+			t.Errorf("parseGiftIdeas(%.20q) = %q, %v", tt.raw, got, err)
+		}
+	}
+}
+
+func TestCustomFieldLimitsCountCharacters(t *testing.T) {
+	label := strings.Repeat("ü", maxNameLength)
+	defs, err := parseFieldDefs(label + "*\nShoe size")
+	if err != nil || len(defs) != 2 || defs[0].Label != label || !defs[0].Required {
+		t.Fatalf("parseFieldDefs with a %d character label: %v, %v", maxNameLength, defs, err)
+	}
+	if _, err := parseFieldDefs(label + "ü"); err == nil {
+		t.Errorf("parseFieldDefs accepted a %d character label", maxNameLength+1)
+	}
+
+	answer := func(value string) (map[string]string, error) {
+		form := url.Values{"field_" + defs[1].Key: {value}, "field_" + defs[0].Key: {"yes"}}
+		return parseCustomFields(httptest.NewRequest("GET", "/?"+form.Encode(), nil), defs)
+	}
+	value := strings.Repeat("日", maxFieldLength)
+	if fields, err := answer(value); err != nil || fields[defs[1].Key] != value {
+		t.Errorf("%d character answer: %v, %v", maxFieldLength, fields, err)
+	}
+	if _, err := answer(value + "日"); err == nil {
+		t.Errorf("accepted a %d character answer", maxFieldLength+1)
+	}
+}
+
+func TestParseAvoidNames(t *testing.T) {
+	// Any name validateInput accepts can be avoided
+	long := strings.Repeat("ñ", maxNameLength)
+	if _, err := validateInput(long, maxNameLength, "Name"); err != nil {
+		t.Fatalf("validateInput rejected a %d character name: %v", maxNameLength, err)
+	}
+	tests := []struct {
+		raw     string
+		want    []string
+		wantErr bool
+	}{
+		{"", nil, false},
+		{" Ann ,, Bob,", []string{"Ann", "Bob"}, false},
+		{long + ", Ann", []string{long, "Ann"}, false},
+		{long + "ñ", nil, true},
+		{strings.Repeat("Ann,", maxAvoidNames), strings.Fields(strings.Repeat("Ann ", maxAvoidNames)), false},
+		{strings.Repeat("Ann,", maxAvoidNames+1), nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseAvoidNames(tt.raw)
+		if (err != nil) != tt.wantErr || !slices.Equal(got, tt.want) {
+			t.Errorf("parseAvoidNames(%.20q) = %q, %v", tt.raw, got, err)
+		}
+	}
+}
+
+func TestTemplatesEscapeUserContent(t *testing.T) {
+	const evil = "<script>alert(1)</script>"
+	draw := addTestDraw(t, "xss", "Ann", "Bob", "Cat")
+	draw.Name = evil + " party"
+	draw.CustomFieldDefinitions = []FieldDef{{Key: "size", Label: evil + " size", MaxLength: maxFieldLength}}
+	for _, p := range draw.Participants {
+		p.Name = evil + p.Name
+		p.Wish = evil + " socks"
+		p.GiftIdeas = []string{evil + " a book"}
+		p.Avoid = []string{evil}
+		p.CustomFields = map[string]string{"size": evil + " M"}
+	}
+
+	check := func(t *testing.T, path string) {
+		rec := serve(t, "GET", path, nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s: %d %s", path, rec.Code, rec.Body)
+		}
+		body := rec.Body.String()
+		if strings.Contains(body, evil) {
+			t.Errorf("GET %s renders user content unescaped", path)
+		}
+		if !strings.Contains(body, html.EscapeString(evil)) {
+			t.Errorf("GET %s doesn't show the escaped content", path)
+		}
+	}
+	pages := []string{
+		"/draw/xss/join",
+		"/draw/xss/manage?organizer=t-Ann",
+		"/draw/xss/manage",
+		"/draw/xss/participant/t-Bob",
+		"/draw/xss/roster?token=t-Bob",
+	}
+	for _, path := range pages {
+		t.Run("before the draw "+path, func(t *testing.T) { check(t, path) })
+	}
+
+	if rec := serve(t, "POST", "/draw/xss/draw", nil); rec.Code != http.StatusSeeOther {
+		t.Fatalf("draw: got %d %s", rec.Code, rec.Body)
+	}
+	for _, path := range pages[1:] {
+		t.Run("after the draw "+path, func(t *testing.T) { check(t, path) })
+	}
+}
+
+func TestCreateIsIdempotent(t *testing.T) {
+	saved := createLimiter
+	createLimiter = ratelimit.New(1, time.Minute)
+	defer func() { createLimiter = saved }()
+	dataMutex.RLock()
+	before := len(appData.Events)
+	dataMutex.RUnlock()
+
+	create := func(key string) *httptest.ResponseRecorder {
+		form := url.Values{"eventname": {"Office party"}, "organizername": {"Ann"}, "organizerwish": {"socks"}, "expected": {"3"}}
+		r := httptest.NewRequest("POST", "/draw/create", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Idempotency-Key", key)
+		r.RemoteAddr = "198.51.100.44:1234"
+		rec := httptest.NewRecorder()
+		createDrawHandler(rec, r)
+		return rec
+	}
+
+	first := create("form-1")
+	// The resubmit also gets past a rate limit the first submit used up
+	second := create("form-1")
+	if first.Code != http.StatusSeeOther || second.Code != http.StatusSeeOther {
+		t.Fatalf("got %d and %d, want two redirects", first.Code, second.Code)
+	}
+	location := first.Header().Get("Location")
+	if second.Header().Get("Location") != location {
+		t.Errorf("resubmit sent to %q, want %q", second.Header().Get("Location"), location)
+	}
+	id := strings.Split(location, "/")[2]
+	defer func() {
+		dataMutex.Lock()
+		delete(appData.Events, id)
+		dataMutex.Unlock()
+	}()
+	dataMutex.RLock()
+	after := len(appData.Events)
+	dataMutex.RUnlock()
+	if after != before+1 {
+		t.Errorf("%d draws created, want 1", after-before)
+	}
+
+	// A new key is a new draw, and counts against the limit
+	if rec := create("form-2"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("create with another key: got %d, want 429", rec.Code)
+	}
+}
+
+func TestVersionEndpoint(t *testing.T) {
+	defer func(saved string) { version = saved }(version)
+	version = "1.2.3"
+	rec := httptest.NewRecorder()
+	versionHandler(rec, httptest.NewRequest("GET", "/version", nil))
+	var body map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("got %d %s", rec.Code, rec.Body)
+	}
+	if body["version"] != "1.2.3" || len(body) != 1 {
+		t.Errorf("got %v, want the injected version", body)
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+}
+
+func TestBannerShownOnCreatePage(t *testing.T) {
+	defer func(saved Banner) { siteBanner = saved }(siteBanner)
+	home := func() string {
+		rec := httptest.NewRecorder()
+		homeHandler(rec, httptest.NewRequest("GET", "/", nil))
+		return rec.Body.String()
+	}
+
+	t.Setenv("BANNER", "")
+	siteBanner = loadBanner()
+	if body := home(); strings.Contains(body, "site-banner") {
+		t.Errorf("banner shown without BANNER")
+	}
+
+	// The banner is read once at startup, like main does
+	t.Setenv("BANNER", "Maintenance tonight <8pm>")
+	t.Setenv("BANNER_SEVERITY", "warning")
+	siteBanner = loadBanner()
+	body := home()
+	if !strings.Contains(body, `<div class="site-banner site-banner-warning" role="status">Maintenance tonight &lt;8pm&gt;</div>`) {
+		t.Errorf("create page doesn't show the banner:\n%s", body)
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	savedFile := dataFile
+	dryRunMode = false
+	defer func() { dataFile, dryRunMode = savedFile, true }()
+	health := func() (int, map[string]interface{}) {
+		rec := httptest.NewRecorder()
+		healthHandler(rec, httptest.NewRequest("GET", "/healthz", nil))
+		var body map[string]interface{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("/healthz is not JSON: %q", rec.Body)
+		}
+		return rec.Code, body
+	}
+
+	dataFile = filepath.Join(t.TempDir(), "data.json")
+	if code, body := health(); code != http.StatusOK || body["status"] != "ok" || body["dryRun"] != false {
+		t.Errorf("healthy: got %d %v", code, body)
+	}
+	// A directory where the data file should be can't be read
+	os.Mkdir(dataFile, 0755)
+	if code, body := health(); code != http.StatusServiceUnavailable || body["status"] != "unhealthy" {
+		t.Errorf("unreadable store: got %d %v", code, body)
+	}
+}
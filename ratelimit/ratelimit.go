@@ -0,0 +1,92 @@
+// Package ratelimit limits how often a key, such as a client IP address, may
+// do something within a sliding time window.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Limiter allows at most limit events per key in any window-long period.
+// Unlike a token bucket refilled on a schedule, a sliding window never lets a
+// burst of twice the limit through around a refill.
+type Limiter struct {
+	mu        sync.Mutex
+	limit     int
+	window    time.Duration
+	keys      map[string]*history
+	lastSweep time.Time
+
+	// now is the clock, replaceable in tests
+	now func() time.Time
+}
+
+// history is a circular buffer of the last limit event times of one key, so a
+// key never uses more than limit*8 bytes of timestamps
+type history struct {
+	times []int64 // unix nanoseconds
+	start int     // index of the oldest event
+	count int
+}
+
+// New returns a Limiter allowing limit events per key per window. A limit of
+// zero or less disables limiting.
+func New(limit int, window time.Duration) *Limiter {
+	return &Limiter{
+		limit:  limit,
+		window: window,
+		keys:   make(map[string]*history),
+		now:    time.Now,
+	}
+}
+
+// Allow records an event for key and reports whether it is within the limit.
+// Rejected events are not recorded.
+func (l *Limiter) Allow(key string) bool {
+	if l.limit <= 0 {
+		return true
+	}
+	now := l.now()
+	cutoff := now.Add(-l.window).UnixNano()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) > l.window {
+		l.sweep(cutoff)
+		l.lastSweep = now
+	}
+
+	h := l.keys[key]
+	if h == nil {
+		h = &history{times: make([]int64, l.limit)}
+		l.keys[key] = h
+	}
+	h.prune(cutoff)
+	if h.count >= l.limit {
+		return false
+	}
+	h.times[(h.start+h.count)%len(h.times)] = now.UnixNano()
+	h.count++
+	return true
+}
+
+// prune drops the events at or before cutoff, the oldest are first
+func (h *history) prune(cutoff int64) {
+	for h.count > 0 && h.times[h.start] <= cutoff {
+		h.start = (h.start + 1) % len(h.times)
+		h.count--
+	}
+}
+
+// sweep forgets keys without events in the current window so the map doesn't
+// grow with every address ever seen.
+// Note: This function should be called when mu is already locked
+func (l *Limiter) sweep(cutoff int64) {
+	for key, h := range l.keys {
+		h.prune(cutoff)
+		if h.count == 0 {
+			delete(l.keys, key)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package ratelimit
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock tests move by hand
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+// newTestLimiter returns a Limiter driven by a fake clock
+func newTestLimiter(limit int, window time.Duration) (*Limiter, *fakeClock) {
+	clock := &fakeClock{t: time.Date(2024, 12, 1, 12, 0, 0, 0, time.UTC)}
+	l := New(limit, window)
+	l.now = clock.now
+	return l, clock
+}
+
+func TestAllowUpToLimitPerKey(t *testing.T) {
+	l, _ := newTestLimiter(3, time.Minute)
+	for i := 0; i < 3; i++ {
+		if !l.Allow("a") {
+			t.Fatalf("event %d rejected, want the first 3 allowed", i+1)
+		}
+	}
+	if l.Allow("a") {
+		t.Errorf("4th event in the window allowed")
+	}
+	if !l.Allow("b") {
+		t.Errorf("another key was limited too")
+	}
+}
+
+func TestNoBurstAtWindowBoundary(t *testing.T) {
+	l, clock := newTestLimiter(3, time.Minute)
+	// Spend the whole limit at the end of one minute...
+	clock.advance(59 * time.Second)
+	for i := 0; i < 3; i++ {
+		if !l.Allow("a") {
+			t.Fatalf("event %d rejected", i+1)
+		}
+	}
+	// ...a fixed window or a refilled bucket would allow 3 more just after it
+	clock.advance(2 * time.Second)
+	if l.Allow("a") {
+		t.Fatalf("burst allowed right after the minute turned")
+	}
+	// Only once a whole window has passed since those events
+	clock.advance(58*time.Second - time.Nanosecond)
+	if l.Allow("a") {
+		t.Errorf("event allowed before the window passed")
+	}
+	clock.advance(time.Nanosecond)
+	if !l.Allow("a") {
+		t.Errorf("event rejected a whole window after the others")
+	}
+}
+
+func TestOldEventsArePruned(t *testing.T) {
+	l, clock := newTestLimiter(3, time.Minute)
+	for i := 0; i < 3; i++ {
+		l.Allow("a")
+		clock.advance(10 * time.Second)
+	}
+	// At 60s the first event (at 0s) leaves the window, the others stay
+	clock.advance(30 * time.Second)
+	if !l.Allow("a") {
+		t.Fatalf("event rejected after the oldest left the window")
+	}
+	if l.Allow("a") {
+		t.Errorf("pruning dropped events still in the window")
+	}
+	if h := l.keys["a"]; h.count != 3 {
+		t.Errorf("history holds %d events, want 3", h.count)
+	}
+}
+
+func TestRejectedEventsAreNotRecorded(t *testing.T) {
+	l, clock := newTestLimiter(1, time.Minute)
+	l.Allow("a")
+	for i := 0; i < 5; i++ {
+		clock.advance(10 * time.Second)
+		if l.Allow("a") {
+			t.Fatalf("event allowed over the limit")
+		}
+	}
+	// Retrying while limited must not push the next allowed event further out
+	clock.advance(10 * time.Second)
+	if !l.Allow("a") {
+		t.Errorf("rejected retries were counted as events")
+	}
+}
+
+func TestIdleKeysAreSwept(t *testing.T) {
+	l, clock := newTestLimiter(2, time.Minute)
+	l.Allow("idle")
+	l.Allow("busy")
+	clock.advance(30 * time.Second)
+	l.Allow("busy")
+
+	// The sweep runs at most once per window
+	clock.advance(31 * time.Second)
+	l.Allow("new")
+	if _, ok := l.keys["idle"]; ok {
+		t.Errorf("idle key kept after a window without events")
+	}
+	if _, ok := l.keys["busy"]; !ok {
+		t.Errorf("key with an event in the window was swept")
+	}
+	if len(l.keys) != 2 {
+		t.Errorf("%d keys tracked, want busy and new", len(l.keys))
+	}
+}
+
+func TestMemoryPerKeyIsCapped(t *testing.T) {
+	l, clock := newTestLimiter(5, time.Minute)
+	for i := 0; i < 1000; i++ {
+		l.Allow("a")
+		clock.advance(time.Second)
+	}
+	if h := l.keys["a"]; len(h.times) != 5 || cap(h.times) != 5 {
+		t.Errorf("key keeps %d timestamps, want at most the limit of 5", cap(h.times))
+	}
+
+	// One entry per key, each bounded the same way
+	for i := 0; i < 100; i++ {
+		l.Allow(fmt.Sprint("key", i))
+	}
+	for key, h := range l.keys {
+		if cap(h.times) != 5 {
+			t.Errorf("%s keeps %d timestamps", key, cap(h.times))
+		}
+	}
+}
+
+func TestZeroLimitDisablesLimiting(t *testing.T) {
+	for _, limit := range []int{0, -1} {
+		l, _ := newTestLimiter(limit, time.Minute)
+		for i := 0; i < 100; i++ {
+			if !l.Allow("a") {
+				t.Fatalf("limit %d: event %d rejected", limit, i+1)
+			}
+		}
+		if len(l.keys) != 0 {
+			t.Errorf("limit %d: %d keys tracked", limit, len(l.keys))
+		}
+	}
+}